@@ -0,0 +1,265 @@
+package dumpy
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ChunkCache hands out chunk contents during a restore, downloading each
+// chunk at most once. It is told up front how many times each chunk will be
+// asked for (see Plan) and drops a chunk after its last use. Chunks are kept
+// in memory up to max_mem bytes and spilled to a scratch directory beyond
+// that, so only chunks that are still needed ever take up space.
+type ChunkCache struct {
+	bucket   string
+	progress chan Progress
+
+	mu        sync.Mutex
+	uses      map[string]int
+	mem       map[string][]byte
+	mem_bytes int64
+	max_mem   int64
+	dir       string
+	dir_once  sync.Once
+	on_disk   map[string]bool
+	fetching  map[string]chan bool
+
+	downloaded int64
+}
+
+func NewChunkCache(bucket string, max_mem int64) *ChunkCache {
+	return &ChunkCache{
+		bucket:   bucket,
+		uses:     make(map[string]int),
+		mem:      make(map[string][]byte),
+		max_mem:  max_mem,
+		on_disk:  make(map[string]bool),
+		fetching: make(map[string]chan bool),
+	}
+}
+
+// Plan records that every chunk of files will be asked for once per use and
+// returns the logical and unique (deduplicated) number of bytes involved.
+func (cc *ChunkCache) Plan(files [][]Chunk) (logical int64, unique int64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, chunks := range files {
+		if chunks[0].LinkTarget != "" {
+			continue
+		}
+		for _, c := range chunks {
+			if cc.uses[c.Md5sum] == 0 {
+				unique += chunkSize(c)
+			}
+			cc.uses[c.Md5sum]++
+			logical += chunkSize(c)
+		}
+	}
+	return logical, unique
+}
+
+// Get returns the contents of c, fetching it if no one has yet.
+func (cc *ChunkCache) Get(c Chunk) ([]byte, error) {
+	cc.mu.Lock()
+	for {
+		if data, ok := cc.mem[c.Md5sum]; ok {
+			cc.used(c.Md5sum)
+			cc.mu.Unlock()
+			return data, nil
+		}
+		if cc.on_disk[c.Md5sum] {
+			// Our use of it is still counted, so no one else will
+			// remove the file while we read it.
+			name := filepath.Join(cc.dir, c.Md5sum)
+			cc.mu.Unlock()
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				log.Fatal("Error reading cached chunk: ", err)
+			}
+			cc.Skip(c)
+			return data, nil
+		}
+		wait, ok := cc.fetching[c.Md5sum]
+		if !ok {
+			break
+		}
+		// Someone else is downloading it; wait for them and look again.
+		cc.mu.Unlock()
+		<-wait
+		cc.mu.Lock()
+	}
+	done := make(chan bool)
+	cc.fetching[c.Md5sum] = done
+	cc.mu.Unlock()
+
+	data, err := fetchChunk(cc.bucket, c)
+
+	cc.mu.Lock()
+	if err == nil {
+		cc.downloaded += int64(len(data))
+	}
+	spill := err == nil && cc.uses[c.Md5sum] > 1 && !cc.keep(c.Md5sum, data)
+	cc.mu.Unlock()
+	if spill {
+		// Written before anyone waiting is woken, so they find it.
+		cc.spill(c.Md5sum, data)
+	}
+	cc.mu.Lock()
+	delete(cc.fetching, c.Md5sum)
+	close(done)
+	spilled := cc.used(c.Md5sum)
+	cc.mu.Unlock()
+	removeSpilled(spilled)
+	if err != nil {
+		return nil, err
+	}
+	if cc.progress != nil {
+		cc.progress <- Progress{"downloaded", uint64(len(data))}
+	}
+	return data, nil
+}
+
+type fetchedChunk struct {
+	c   Chunk // with data filled in
+	err error
+}
+
+// Stream fetches chunks through the cache and delivers them in the order
+// given, with at most readahead of them in flight ahead of the reader. The
+// reader must call stop if it gives up before the channel is closed. stop
+// waits for the fetches already started, so none of them outlives the
+// restore (and its progress channel and scratch directory).
+func (cc *ChunkCache) Stream(chunks []Chunk, readahead int) (<-chan fetchedChunk, func()) {
+	out := make(chan fetchedChunk)
+	pending := make(chan chan fetchedChunk, readahead)
+	done := make(chan bool)
+
+	go func() {
+		defer close(pending)
+		for i, c := range chunks {
+			ch := make(chan fetchedChunk, 1)
+			select {
+			case pending <- ch:
+			case <-done:
+				for _, c := range chunks[i:] {
+					cc.Skip(c)
+				}
+				return
+			}
+			go func(c Chunk) {
+				var err error
+				c.data, err = cc.Get(c)
+				ch <- fetchedChunk{c, err}
+			}(c)
+		}
+	}()
+
+	// Every fetch that was started is waited for here, so out is only
+	// closed once they have all finished.
+	go func() {
+		defer close(out)
+		for ch := range pending {
+			select {
+			case out <- <-ch:
+			case <-done:
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(done) })
+		for range out {
+		}
+	}
+	return out, stop
+}
+
+// Skip gives up one planned use of c without reading it, e.g. because the
+// file it belongs to was skipped.
+func (cc *ChunkCache) Skip(c Chunk) {
+	cc.mu.Lock()
+	spilled := cc.used(c.Md5sum)
+	cc.mu.Unlock()
+	removeSpilled(spilled)
+}
+
+// Downloaded is the number of bytes fetched from the bucket so far.
+func (cc *ChunkCache) Downloaded() int64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.downloaded
+}
+
+// Close throws away anything still cached.
+func (cc *ChunkCache) Close() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.dir != "" {
+		os.RemoveAll(cc.dir)
+	}
+	cc.mem = make(map[string][]byte)
+	cc.mem_bytes = 0
+}
+
+// spill writes a chunk that doesn't fit in memory to the scratch directory.
+// It is called without mu held.
+func (cc *ChunkCache) spill(id string, data []byte) {
+	cc.dir_once.Do(func() {
+		dir, err := ioutil.TempDir("", "dumpy-chunks")
+		if err != nil {
+			log.Fatal("Can't create chunk cache: ", err)
+		}
+		cc.mu.Lock()
+		cc.dir = dir
+		cc.mu.Unlock()
+	})
+	err := ioutil.WriteFile(filepath.Join(cc.dir, id), data, 0600)
+	if err != nil {
+		log.Fatal("Error writing cached chunk: ", err)
+	}
+	cc.mu.Lock()
+	cc.on_disk[id] = true
+	cc.mu.Unlock()
+}
+
+func removeSpilled(name string) {
+	if name != "" {
+		os.Remove(name)
+	}
+}
+
+// Everything below is called with mu held.
+
+// keep holds on to data in memory if it fits under max_mem.
+func (cc *ChunkCache) keep(id string, data []byte) bool {
+	if cc.mem_bytes+int64(len(data)) > cc.max_mem {
+		return false
+	}
+	cc.mem[id] = data
+	cc.mem_bytes += int64(len(data))
+	return true
+}
+
+// used counts off one use of a chunk and forgets the chunk after its last.
+// It returns the chunk's spill file, if any, for the caller to remove once
+// mu is released.
+func (cc *ChunkCache) used(id string) string {
+	if cc.uses[id] > 1 {
+		cc.uses[id]--
+		return ""
+	}
+	delete(cc.uses, id)
+	if data, ok := cc.mem[id]; ok {
+		cc.mem_bytes -= int64(len(data))
+		delete(cc.mem, id)
+	}
+	if cc.on_disk[id] {
+		delete(cc.on_disk, id)
+		return filepath.Join(cc.dir, id)
+	}
+	return ""
+}
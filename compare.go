@@ -0,0 +1,86 @@
+package dumpy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localIndex walks dir with walkDirectory, as a backup of it would, and
+// describes what it finds as index entries, with paths relative to dir.
+// With hash, files are read and given content IDs; otherwise ContentId is
+// left empty and only sizes can be compared. Nothing is uploaded.
+func localIndex(dir string, hash bool) []IndexEntry {
+	entries := []IndexEntry{}
+	for c := range walkDirectory([]string{dir}) {
+		if c.Offset != 0 {
+			continue // one entry per file, from its first chunk
+		}
+		e := IndexEntry{
+			Path:    strings.TrimPrefix(c.Path, strings.TrimSuffix(dir, "/")),
+			Size:    c.FileSize,
+			ModTime: c.FileModTime,
+			Mode:    c.FilePerm,
+			Uid:     c.Uid,
+			Gid:     c.Gid,
+		}
+		var err error
+		if c.FilePerm&os.ModeSymlink != 0 {
+			e.LinkTarget, err = os.Readlink(c.Path)
+			if err != nil {
+				log.Println("Failed to read link: ", c.Path, ": ", err)
+			}
+			e.ContentId = FileContentID([]Chunk{{LinkTarget: e.LinkTarget}})
+		} else if hash && c.FilePerm.IsRegular() {
+			e.ContentId, err = localContentID(c.Path, c.FileSize)
+			if err != nil {
+				log.Println("Can't hash ", c.Path, ": ", err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// localContentID reads a file in 1MB chunks, as a backup would (an empty
+// file is one empty chunk), and gives the content ID the backup would
+// record for it.
+func localContentID(p string, size int64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	chunks := []Chunk{}
+	buf := make([]byte, 1<<20)
+	for o := int64(0); o == 0 || o < size; o += 1 << 20 {
+		n, err := io.ReadFull(f, buf[:min(1<<20, size-o)])
+		if err != nil {
+			return "", err
+		}
+		csum := md5.Sum(buf[:n])
+		chunks = append(chunks, Chunk{Offset: o, Md5sum: hex.EncodeToString(csum[:])})
+	}
+	return FileContentID(chunks), nil
+}
+
+// CompareLocal compares the directory dir on this machine with the part of
+// snapshot under prefix. In the result, files only on disk are "added"
+// and files only in the snapshot "removed". Without hash, files are taken
+// to have the same contents if they are the same size.
+func CompareLocal(bucket string, snapshot string, prefix string, dir string, hash bool) *Diff {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &Diff{
+		From:    snapshot + path.Clean("/"+prefix),
+		To:      dir,
+		Changes: DiffIndexes(SubIndex(LoadIndex(bucket, snapshot), prefix), localIndex(dir, hash)),
+	}
+}
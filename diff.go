@@ -0,0 +1,198 @@
+package dumpy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Kinds of change between two snapshots.
+const (
+	DiffAdded    = "added"
+	DiffRemoved  = "removed"
+	DiffModified = "modified" // contents differ
+	DiffMetadata = "metadata" // same contents, different mode, owner or mtime
+)
+
+// DiffEntry is one path that differs between two snapshots.
+type DiffEntry struct {
+	Path    string
+	Change  string
+	Dir     bool     `json:",omitempty"`
+	OldSize int64    `json:",omitempty"`
+	NewSize int64    `json:",omitempty"`
+	Fields  []string `json:",omitempty"` // for DiffMetadata: mode, owner, mtime
+}
+
+// Diff is everything that changed from one snapshot to another.
+type Diff struct {
+	From    string
+	To      string
+	Changes []DiffEntry
+}
+
+// SubIndex keeps the entries under prefix, with their paths made relative
+// to it (but still starting with /).
+func SubIndex(entries []IndexEntry, prefix string) []IndexEntry {
+	prefix = strings.TrimSuffix(path.Clean("/"+prefix), "/")
+	if prefix == "" {
+		return entries
+	}
+	ret := []IndexEntry{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Path, prefix+"/") {
+			e.Path = strings.TrimPrefix(e.Path, prefix)
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// indexDirs gives every directory in an index, whether the manifest had an
+// entry for it or only for things inside it.
+func indexDirs(entries []IndexEntry) map[string]*IndexEntry {
+	dirs := make(map[string]*IndexEntry)
+	for i := range entries {
+		p := entries[i].Path
+		if strings.HasSuffix(p, "/") {
+			dirs[strings.TrimSuffix(p, "/")] = &entries[i]
+		}
+		for d := path.Dir(strings.TrimSuffix(p, "/")); d != "/" && d != "."; d = path.Dir(d) {
+			if _, ok := dirs[d]; !ok {
+				dirs[d] = nil
+			}
+		}
+	}
+	return dirs
+}
+
+func metadataChanges(a *IndexEntry, b *IndexEntry) []string {
+	fields := []string{}
+	if a.Mode != b.Mode {
+		fields = append(fields, "mode "+a.Mode.String()+" -> "+b.Mode.String())
+	}
+	if a.Uid != b.Uid || a.Gid != b.Gid {
+		fields = append(fields, fmt.Sprintf("owner %d:%d -> %d:%d", a.Uid, a.Gid, b.Uid, b.Gid))
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		fields = append(fields, "mtime "+a.ModTime.Format("2006-01-02 15:04:05")+" -> "+b.ModTime.Format("2006-01-02 15:04:05"))
+	}
+	return fields
+}
+
+// sameContent compares content IDs, or only sizes if either side doesn't
+// have one (a local file that wasn't hashed).
+func sameContent(a *IndexEntry, b *IndexEntry) bool {
+	if a.ContentId == "" || b.ContentId == "" {
+		return a.Size == b.Size && a.LinkTarget == b.LinkTarget
+	}
+	return a.ContentId == b.ContentId
+}
+
+// DiffIndexes compares two indexes. Files are compared by content ID, so
+// nothing is downloaded; directories by whether they exist and, where the
+// manifests recorded them, their metadata. Changes are sorted by path.
+func DiffIndexes(from []IndexEntry, to []IndexEntry) []DiffEntry {
+	changes := []DiffEntry{}
+	files := func(entries []IndexEntry) map[string]*IndexEntry {
+		m := make(map[string]*IndexEntry)
+		for i := range entries {
+			if !strings.HasSuffix(entries[i].Path, "/") {
+				m[entries[i].Path] = &entries[i]
+			}
+		}
+		return m
+	}
+	a, b := files(from), files(to)
+	for p, e := range a {
+		f, ok := b[p]
+		switch {
+		case !ok:
+			changes = append(changes, DiffEntry{Path: p, Change: DiffRemoved, OldSize: e.Size})
+		case !sameContent(e, f):
+			changes = append(changes, DiffEntry{Path: p, Change: DiffModified, OldSize: e.Size, NewSize: f.Size})
+		default:
+			if fields := metadataChanges(e, f); len(fields) > 0 {
+				changes = append(changes, DiffEntry{Path: p, Change: DiffMetadata, OldSize: e.Size, NewSize: f.Size, Fields: fields})
+			}
+		}
+	}
+	for p, f := range b {
+		if _, ok := a[p]; !ok {
+			changes = append(changes, DiffEntry{Path: p, Change: DiffAdded, NewSize: f.Size})
+		}
+	}
+
+	da, db := indexDirs(from), indexDirs(to)
+	for d, e := range da {
+		f, ok := db[d]
+		if !ok {
+			changes = append(changes, DiffEntry{Path: d + "/", Change: DiffRemoved, Dir: true})
+		} else if e != nil && f != nil {
+			if fields := metadataChanges(e, f); len(fields) > 0 {
+				changes = append(changes, DiffEntry{Path: d + "/", Change: DiffMetadata, Dir: true, Fields: fields})
+			}
+		}
+	}
+	for d := range db {
+		if _, ok := da[d]; !ok {
+			changes = append(changes, DiffEntry{Path: d + "/", Change: DiffAdded, Dir: true})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// DiffSnapshots compares the part of two snapshots under prefix, using the
+// local index of each.
+func DiffSnapshots(bucket string, from string, to string, prefix string) *Diff {
+	return &Diff{
+		From:    from,
+		To:      to,
+		Changes: DiffIndexes(SubIndex(LoadIndex(bucket, from), prefix), SubIndex(LoadIndex(bucket, to), prefix)),
+	}
+}
+
+// PrintText writes one line per change, marked + (added), - (removed), M
+// (contents changed) or m (metadata only), followed by totals.
+func (d *Diff) PrintText(w io.Writer) {
+	marks := map[string]string{DiffAdded: "+", DiffRemoved: "-", DiffModified: "M", DiffMetadata: "m"}
+	counts := make(map[string]int)
+	var added, removed int64
+	for _, c := range d.Changes {
+		counts[c.Change]++
+		line := marks[c.Change] + " " + c.Path
+		switch {
+		case c.Dir && c.Change != DiffMetadata:
+		case c.Change == DiffAdded:
+			line += " (" + humanize.Bytes(uint64(c.NewSize)) + ")"
+			added += c.NewSize
+		case c.Change == DiffRemoved:
+			line += " (" + humanize.Bytes(uint64(c.OldSize)) + ")"
+			removed += c.OldSize
+		case c.Change == DiffModified:
+			line += " (" + humanize.Bytes(uint64(c.OldSize)) + " -> " + humanize.Bytes(uint64(c.NewSize)) + ")"
+			added += c.NewSize
+			removed += c.OldSize
+		case c.Change == DiffMetadata:
+			line += " (" + strings.Join(c.Fields, ", ") + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "%s -> %s: %d added, %d removed, %d modified, %d metadata only; +%s -%s\n",
+		d.From, d.To, counts[DiffAdded], counts[DiffRemoved], counts[DiffModified], counts[DiffMetadata],
+		humanize.Bytes(uint64(added)), humanize.Bytes(uint64(removed)))
+}
+
+func (d *Diff) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(d)
+}
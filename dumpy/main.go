@@ -3,27 +3,226 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/fdabek/dumpy"
 )
 
+// modeArg finds -mode's value before the command line is parsed, so that
+// flags only one mode takes can be registered for that mode alone.
+func modeArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue // another flag's value
+		}
+		if strings.HasPrefix(name, "mode=") {
+			return strings.TrimPrefix(name, "mode=")
+		}
+		if name == "mode" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	root := flag.String("directory", "", "Directory to scan")
 	bucket := flag.String("bucket", "", "Bucket for chunks")
-	mode := flag.String("mode", "", "backup|restore")
-	chown := flag.Bool("chown", true, "automatic chown")
+	mode := flag.String("mode", "", "backup|restore|interactive|export|import|stream|serve|webdav|cat|find|versions|diff|compare")
+	snapshot := flag.String("snapshot", "", "Snapshot to use (host/2006-01-02@03:04)")
+	path := flag.String("path", "", "Path inside the snapshot (default /; for compare, the -directory's own path)")
+	command := flag.String("command", "", "Command whose output to back up (stream mode; default stdin)")
+	format := flag.String("format", "tar", "Archive format for export: tar|zip")
+	output := flag.String("output", "-", "Output file, - for stdout")
+	tarfile := flag.String("tar", "-", "Tar file to import, - for stdin")
+	host := flag.String("host", "", "Host to file a snapshot under or look one up in (default this machine; find: every host)")
+	prefix := flag.String("prefix", "/", "Directory to place imported files under")
+	listen := flag.String("listen", "localhost:8080", "Address to serve on")
+	to := flag.String("to", "", "Snapshot to compare -snapshot with (diff mode)")
+	as_json := flag.Bool("json", false, "Print JSON (diff and compare modes)")
+	hash := flag.Bool("hash", false, "Hash local files to compare contents, not just sizes (compare mode)")
+	name := flag.String("name", "", "Name, or path with a /, to find (* ? [...] and ** work)")
+	version := flag.Int("version", 0, "Version to print, as numbered by versions mode with no -version")
+	restore_version := flag.Bool("restore", false, "Restore -version instead of printing it (versions mode)")
+	var filter dumpy.SnapshotFilter
+	filter.AddFlags(flag.CommandLine)
+	var opts dumpy.RestoreOptions
+	flag.BoolVar(&opts.Chown, "chown", true, "automatic chown")
+	opts.AddFlags(flag.CommandLine)
+	if m := modeArg(os.Args[1:]); m == "restore" || m == "versions" {
+		opts.AddRunFlags(flag.CommandLine)
+	}
 
 	flag.Parse()
+	if err := opts.Check(); err != nil {
+		log.Fatal(err)
+	}
+	this_host := *host
+	if this_host == "" {
+		this_host, _ = os.Hostname()
+	}
 
 	dumpy.InitStorageClient()
 	if *mode == "backup" {
 		roots := strings.Split(*root, ",")
 		dumpy.BackupFromRoots(*bucket, roots)
+	} else if *mode == "cat" {
+		if *snapshot == "" {
+			log.Fatalf("-snapshot required for cat\n")
+		}
+		entry := dumpy.LookupPath(dumpy.LoadSnapshot(*bucket, *snapshot), *path)
+		if entry == nil {
+			log.Fatalf("%s not found in %s\n", *path, *snapshot)
+		}
+		err := dumpy.CatFile(*bucket, entry, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *mode == "import" {
+		dumpy.ImportTar(*bucket, this_host, *tarfile, *prefix)
+	} else if *mode == "stream" {
+		if *path == "" || *path == "/" {
+			log.Fatalf("-path required for stream (e.g. /db/prod.sql)\n")
+		}
+		dumpy.BackupStream(*bucket, this_host, *path, *command)
+	} else if *mode == "restore" {
+		if *snapshot == "" {
+			log.Fatalf("-snapshot required for restore\n")
+		}
+		report := dumpy.RestoreAll(*bucket, dumpy.SnapshotMetadata(*snapshot), &opts)
+		if !report.Ok() {
+			os.Exit(1)
+		}
 	} else if *mode == "interactive" {
-		dumpy.InteractiveRestoreTerminal(*bucket, *chown)
+		dumpy.InteractiveRestoreTerminal(*bucket, opts)
+	} else if *mode == "export" {
+		if *snapshot == "" {
+			log.Fatalf("-snapshot required for export\n")
+		}
+		entry := dumpy.LookupPath(dumpy.LoadSnapshot(*bucket, *snapshot), *path)
+		if entry == nil {
+			log.Fatalf("%s not found in %s\n", *path, *snapshot)
+		}
+		out := os.Stdout
+		if *output != "-" {
+			var err error
+			out, err = os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err := dumpy.ExportArchive(*bucket, entry, *format, out)
+		if err != nil {
+			log.Fatal("Export failed: ", err)
+		}
+		err = out.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *mode == "find" {
+		if *name == "" {
+			log.Fatalf("-name required for find\n")
+		}
+		filter.Host = *host
+		results, err := dumpy.FindFiles(*bucket, filter, *name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dumpy.PrintFindResults(os.Stdout, results)
+	} else if *mode == "versions" {
+		if *path == "" || *path == "/" {
+			log.Fatalf("-path required for versions\n")
+		}
+		versions := dumpy.FileVersions(*bucket, this_host, *path)
+		if *version == 0 {
+			dumpy.PrintVersions(os.Stdout, versions)
+			return
+		}
+		if *version < 1 || *version > len(versions) {
+			log.Fatalf("No version %d of %s; there are %d\n", *version, *path, len(versions))
+		}
+		snap := versions[*version-1].Newest()
+		entry := dumpy.LookupPath(dumpy.LoadSnapshot(*bucket, snap), *path)
+		if entry == nil {
+			log.Fatalf("%s not found in %s\n", *path, snap)
+		}
+		if *restore_version {
+			files := dumpy.SubtreeFiles(entry)
+			if opts.DryRun {
+				dumpy.DryRunRestore(os.Stdout, &opts, files)
+				return
+			}
+			report := dumpy.RestoreFiles(*bucket, &opts, files)
+			report.Print(os.Stdout)
+			if !report.Ok() {
+				os.Exit(1)
+			}
+			return
+		}
+		out := os.Stdout
+		if *output != "-" {
+			var err error
+			out, err = os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err := dumpy.CatFile(*bucket, entry, out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = out.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *mode == "diff" {
+		if *snapshot == "" || *to == "" {
+			log.Fatalf("-snapshot and -to required for diff\n")
+		}
+		d := dumpy.DiffSnapshots(*bucket, *snapshot, *to, *path)
+		if *as_json {
+			err := d.PrintJSON(os.Stdout)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			d.PrintText(os.Stdout)
+		}
+	} else if *mode == "compare" {
+		if *snapshot == "" || *root == "" {
+			log.Fatalf("-snapshot and -directory required for compare\n")
+		}
+		// Unless told otherwise, compare with the same path in the
+		// snapshot.
+		prefix := *path
+		if prefix == "" {
+			var err error
+			prefix, err = filepath.Abs(*root)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		d := dumpy.CompareLocal(*bucket, *snapshot, prefix, *root, *hash)
+		if *as_json {
+			err := d.PrintJSON(os.Stdout)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			d.PrintText(os.Stdout)
+		}
+	} else if *mode == "serve" {
+		log.Fatal(dumpy.Serve(*bucket, *listen))
+	} else if *mode == "webdav" {
+		log.Fatal(dumpy.ServeWebDAV(*bucket, *listen))
 	} else {
 		log.Fatalf("Not supported\n")
 	}
@@ -0,0 +1,148 @@
+package dumpy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"time"
+)
+
+type exportItem struct {
+	name string // relative to the root of the export; directories end in /
+	e    *FsEntry
+}
+
+func exportItems(dir *FsEntry, prefix string, items []exportItem) []exportItem {
+	for _, kid := range ListDir(dir) {
+		name := prefix + kid.name
+		if kid.file {
+			items = append(items, exportItem{name, kid})
+		} else {
+			items = append(items, exportItem{name + "/", kid})
+			items = exportItems(kid, name+"/", items)
+		}
+	}
+	return items
+}
+
+// writeEntryData streams a file's chunks to w in offset order.
+func writeEntryData(cache *ChunkCache, e *FsEntry, w io.Writer) error {
+	fetched, stop := cache.Stream(sortChunks(e.chunks), readahead)
+	defer stop()
+	for fc := range fetched {
+		if fc.err != nil {
+			return fc.err
+		}
+		_, err := w.Write(fc.c.data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CatFile streams one file's contents to w.
+func CatFile(bucket string, e *FsEntry, w io.Writer) error {
+	if !e.file {
+		return fmt.Errorf("%s is a directory", e.name)
+	}
+	if e.chunks[0].LinkTarget != "" {
+		return fmt.Errorf("%s is a symlink to %s", e.name, e.chunks[0].LinkTarget)
+	}
+	return writeEntryData(NewChunkCache(bucket, 0), e, w)
+}
+
+// ExportArchive writes the tree under entry to w as a "tar" or "zip"
+// archive, streaming file contents straight from the bucket. Names in the
+// archive are relative to entry; exporting a single file gives an archive
+// holding just that file.
+func ExportArchive(bucket string, entry *FsEntry, format string, w io.Writer) error {
+	var items []exportItem
+	if entry.file {
+		items = []exportItem{{entry.name, entry}}
+	} else {
+		items = exportItems(entry, "", nil)
+	}
+
+	// Chunks are fetched as each file is written and not kept, like
+	// CatFile, so nothing goes to disk however big the tree. A chunk shared
+	// between files is downloaded once per file.
+	cache := NewChunkCache(bucket, 0)
+
+	switch format {
+	case "tar":
+		return exportTar(cache, items, w)
+	case "zip":
+		return exportZip(cache, items, w)
+	}
+	return fmt.Errorf("unknown archive format %q", format)
+}
+
+func exportTar(cache *ChunkCache, items []exportItem, w io.Writer) error {
+	// Directories have no times of their own in a manifest.
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	for _, item := range items {
+		link := ""
+		if item.e.file && item.e.chunks[0].LinkTarget != "" {
+			link = item.e.chunks[0].LinkTarget
+		}
+		hdr, err := tar.FileInfoHeader(EntryInfo(item.e), link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = item.name
+		if item.e.file {
+			hdr.Uid = int(item.e.chunks[0].Uid)
+			hdr.Gid = int(item.e.chunks[0].Gid)
+		} else {
+			hdr.ModTime = now
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			err = writeEntryData(cache, item.e, tw)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func exportZip(cache *ChunkCache, items []exportItem, w io.Writer) error {
+	now := time.Now()
+	zw := zip.NewWriter(w)
+	for _, item := range items {
+		hdr, err := zip.FileInfoHeader(EntryInfo(item.e))
+		if err != nil {
+			return err
+		}
+		hdr.Name = item.name
+		if item.e.file {
+			hdr.Method = zip.Deflate
+		} else {
+			hdr.Modified = now
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !item.e.file {
+			continue
+		}
+		if item.e.chunks[0].LinkTarget != "" {
+			// zip keeps a symlink's target as its contents.
+			_, err = io.WriteString(fw, item.e.chunks[0].LinkTarget)
+		} else {
+			err = writeEntryData(cache, item.e, fw)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -2,12 +2,16 @@ package dumpy
 
 import "encoding/json"
 import "log"
+import "os"
+import "path"
 import "sort"
 import "strings"
+import "time"
 
 type FsEntry struct {
 	name            string
 	file            bool
+	snapshot        bool // the root of one snapshot (a host/date directory)
 	lazy_file_maker func()
 	chunks          []Chunk
 	children        map[string]*FsEntry
@@ -88,11 +92,36 @@ func Walk(dir *FsEntry, depth int, callback func(*FsEntry, []*FsEntry)) {
 	walkHelper(dir, depth, callback, []*FsEntry{})
 }
 
-func walkHelper(dir *FsEntry, depth int, callback func(*FsEntry, []*FsEntry), path []*FsEntry) {
+// SubtreeFiles gathers what restoring e takes: e itself if it's a file,
+// otherwise every file and symlink under it at any depth, plus each
+// directory the manifest recorded so that empty ones come back too.
+func SubtreeFiles(e *FsEntry) [][]Chunk {
+	if e.file {
+		return [][]Chunk{e.chunks}
+	}
+	files := [][]Chunk{}
+	if len(e.chunks) > 0 {
+		files = append(files, e.chunks)
+	}
+	Walk(e, 1<<30, func(kid *FsEntry, path []*FsEntry) {
+		if len(kid.chunks) > 0 {
+			files = append(files, kid.chunks)
+		}
+	})
+	return files
+}
+
+// loadEntry reads in a snapshot's manifest the first time anything looks
+// inside it.
+func loadEntry(dir *FsEntry) {
 	if dir.lazy_file_maker != nil {
 		dir.lazy_file_maker()
 		dir.lazy_file_maker = nil
 	}
+}
+
+func walkHelper(dir *FsEntry, depth int, callback func(*FsEntry, []*FsEntry), path []*FsEntry) {
+	loadEntry(dir)
 
 	q := make([]*FsEntry, 0)
 	for name, entry := range dir.children {
@@ -133,17 +162,162 @@ func ListDir(dir *FsEntry) []*FsEntry {
 	return ret
 }
 
-func ChangeDir(dir *FsEntry, arg string) *FsEntry {
-	kid, ok := dir.children[arg]
-	if !ok || kid.file == true {
+// parent returns the directory containing e (the root is its own parent).
+// Files don't know their parents, so e must be a directory.
+func parent(e *FsEntry) *FsEntry {
+	if p := e.children[".."]; p != nil {
+		return p
+	}
+	return e
+}
+
+// SnapshotRoot returns the snapshot directory that dir is in, or nil if it
+// isn't in one.
+func SnapshotRoot(dir *FsEntry) *FsEntry {
+	for !dir.snapshot {
+		p := parent(dir)
+		if p == dir {
+			return nil
+		}
+		dir = p
+	}
+	return dir
+}
+
+// EntryPath gives the absolute path of directory dir in the tree.
+func EntryPath(dir *FsEntry) string {
+	p := ""
+	for {
+		up := parent(dir)
+		if up == dir {
+			break
+		}
+		p = "/" + dir.name + p
+		dir = up
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// ResolvePath looks p up the way a shell would. Absolute paths start at
+// root (/host/date/...), relative ones at pwd, and "~" at the root of the
+// snapshot pwd is in. ".." never goes above root. Returns nil if there's
+// nothing there.
+func ResolvePath(root *FsEntry, pwd *FsEntry, p string) *FsEntry {
+	dir := pwd
+	if strings.HasPrefix(p, "/") {
+		dir = root
+	} else if p == "~" || strings.HasPrefix(p, "~/") {
+		dir = SnapshotRoot(pwd)
+		if dir == nil {
+			return nil
+		}
+		p = strings.TrimPrefix(p, "~")
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if dir.file {
+			return nil
+		}
+		if part == ".." {
+			if dir != root {
+				dir = parent(dir)
+			}
+			continue
+		}
+		loadEntry(dir)
+		kid, ok := dir.children[part]
+		if !ok || kid == nil {
+			return nil
+		}
+		dir = kid
+	}
+	return dir
+}
+
+// CompletePath extends word, a path being typed into the shell, as far as
+// it unambiguously goes. A unique directory gets a trailing slash so the
+// next TAB carries on inside it.
+func CompletePath(root *FsEntry, pwd *FsEntry, word string) string {
+	dir_part, base := "", word
+	if i := strings.LastIndex(word, "/"); i >= 0 {
+		dir_part, base = word[:i+1], word[i+1:]
+	}
+	dir := pwd
+	if dir_part != "" {
+		dir = ResolvePath(root, pwd, dir_part)
+		if dir == nil || dir.file {
+			return word
+		}
+	}
+
+	matches := []*FsEntry{}
+	for _, f := range ListDir(dir) {
+		if strings.HasPrefix(f.name, base) {
+			matches = append(matches, f)
+		}
+	}
+	if len(matches) == 1 {
+		return dir_part + FormatFilename(matches[0])
+	}
+	stripped := []string{}
+	for _, f := range matches {
+		stripped = append(stripped, strings.TrimPrefix(f.name, base))
+	}
+	return word + LongestPrefixString(stripped)
+}
+
+// CanonicalPath gives the absolute path in the tree (/host/date/...) of
+// what name resolves to, or "" if there's nothing there.
+func CanonicalPath(root *FsEntry, pwd *FsEntry, name string) string {
+	e := ResolvePath(root, pwd, name)
+	if e == nil {
+		return ""
+	}
+	if !e.file {
+		return EntryPath(e)
+	}
+	// Files don't know their parents, so find the directory it's in.
+	name = strings.TrimRight(name, "/")
+	dir, base := pwd, name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		dir, base = ResolvePath(root, pwd, name[:i+1]), name[i+1:]
+	}
+	return strings.TrimSuffix(EntryPath(dir), "/") + "/" + base
+}
+
+// LexicalPath is CanonicalPath worked out from the text of name and pwd's
+// path alone, so nothing is looked up and no manifest is read. What it
+// names may not exist.
+func LexicalPath(pwd *FsEntry, name string) string {
+	dir := EntryPath(pwd)
+	if strings.HasPrefix(name, "/") {
+		dir = "/"
+	} else if name == "~" || strings.HasPrefix(name, "~/") {
+		snap := SnapshotRoot(pwd)
+		if snap == nil {
+			return ""
+		}
+		dir = EntryPath(snap)
+		name = strings.TrimPrefix(name, "~")
+	}
+	return path.Clean(dir + "/" + name)
+}
+
+func ChangeDir(root *FsEntry, dir *FsEntry, arg string) *FsEntry {
+	kid := ResolvePath(root, dir, arg)
+	if kid == nil || kid.file == true {
 		return nil
 	}
 	return kid
 }
 
-func GetFSEntry(dir *FsEntry, filename string) *FsEntry {
-	f := dir.children[filename]
-	return f
+func GetFSEntry(root *FsEntry, dir *FsEntry, filename string) *FsEntry {
+	return ResolvePath(root, dir, filename)
 }
 
 func FormatFilename(entry *FsEntry) string {
@@ -152,3 +326,96 @@ func FormatFilename(entry *FsEntry) string {
 	}
 	return entry.name + "/"
 }
+
+// LookupPath follows a slash separated path down from dir, returning nil if
+// some part of it doesn't exist.
+func LookupPath(dir *FsEntry, p string) *FsEntry {
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if dir.file {
+			return nil
+		}
+		loadEntry(dir)
+		kid, ok := dir.children[part]
+		if !ok || kid == nil {
+			return nil
+		}
+		dir = kid
+	}
+	return dir
+}
+
+// MetadataTree builds a tree with a host/date directory for every snapshot
+// in the bucket. A snapshot's manifest is only read when something looks
+// inside its directory.
+func MetadataTree(bucket string) *FsEntry {
+	root := MakeDirEntry("", nil)
+	for s := range ListMetadata(bucket) {
+		md_path := strings.TrimSuffix(strings.TrimPrefix(s, "/metadata"), "backup.json")
+		dumb := s
+		d := InsertPath(md_path, root)
+		d.snapshot = true
+		d.lazy_file_maker = func() { InsertFromJSON(d, bucket, dumb) }
+	}
+	return root
+}
+
+// LoadSnapshot builds the tree for a single snapshot.
+func LoadSnapshot(bucket string, snapshot string) *FsEntry {
+	root := MakeDirEntry("", nil)
+	root.snapshot = true
+	InsertFromJSON(root, bucket, SnapshotMetadata(snapshot))
+	return root
+}
+
+// entryInfo describes an FsEntry as an os.FileInfo, using the metadata
+// recorded with its first chunk. Directories carry no metadata of their own.
+type entryInfo struct {
+	e *FsEntry
+}
+
+func EntryInfo(e *FsEntry) os.FileInfo { return entryInfo{e} }
+
+func (i entryInfo) IsDir() bool { return !i.e.file }
+
+func (i entryInfo) Name() string {
+	if i.e.name == "" {
+		return "." // the root
+	}
+	return i.e.name
+}
+func (i entryInfo) Sys() interface{} {
+	if len(i.e.chunks) == 0 {
+		return nil
+	}
+	return &i.e.chunks[0]
+}
+
+func (i entryInfo) Size() int64 {
+	if !i.e.file || len(i.e.chunks) == 0 {
+		return 0
+	}
+	if i.e.chunks[0].LinkTarget != "" {
+		return int64(len(i.e.chunks[0].LinkTarget))
+	}
+	return i.e.chunks[0].FileSize
+}
+
+func (i entryInfo) Mode() os.FileMode {
+	if !i.e.file {
+		return os.ModeDir | 0755
+	}
+	if len(i.e.chunks) == 0 {
+		return 0644
+	}
+	return i.e.chunks[0].FilePerm
+}
+
+func (i entryInfo) ModTime() time.Time {
+	if !i.e.file || len(i.e.chunks) == 0 {
+		return time.Time{}
+	}
+	return i.e.chunks[0].FileModTime
+}
@@ -0,0 +1,255 @@
+package dumpy
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// shellWord is one word of a shell command line with the quoting removed.
+// pattern is the same word for matching with path.Match, with anything
+// that was quoted escaped, and glob says whether it has unquoted wildcards.
+type shellWord struct {
+	text    string
+	pattern string
+	glob    bool
+	start   int // byte offset in the line
+}
+
+// splitLine breaks a command line into words the way sh does: blanks
+// separate words, '...' and "..." quote, and \ escapes the next character.
+func splitLine(line string) ([]shellWord, error) {
+	words := []shellWord{}
+	var w shellWord
+	var text, pattern strings.Builder
+	in_word := false
+	quote := rune(0)
+	escaped := false
+
+	literal := func(r rune) {
+		text.WriteRune(r)
+		if strings.ContainsRune(`*?[]\`, r) {
+			pattern.WriteByte('\\')
+		}
+		pattern.WriteRune(r)
+	}
+
+	for i, r := range line {
+		blank := r == ' ' || r == '\t'
+		if !in_word && (quote != 0 || escaped || !blank) {
+			in_word = true
+			w = shellWord{start: i}
+		}
+		switch {
+		case escaped:
+			literal(r)
+			escaped = false
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == '\'':
+			literal(r)
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			literal(r)
+		case r == '\'' || r == '"':
+			quote = r
+		case blank:
+			if in_word {
+				w.text, w.pattern = text.String(), pattern.String()
+				words = append(words, w)
+				text.Reset()
+				pattern.Reset()
+				in_word = false
+			}
+		default:
+			text.WriteRune(r)
+			pattern.WriteRune(r)
+			if strings.ContainsRune("*?[", r) {
+				w.glob = true
+			}
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if in_word {
+		w.text, w.pattern = text.String(), pattern.String()
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+// QuoteWord quotes s so that splitLine reads it back as one literal word.
+func QuoteWord(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t'\"\\*?[]") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// hasMeta says whether a path.Match pattern has any unescaped wildcards.
+func hasMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+func unescape(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// GlobPaths finds everything in the tree matching pattern, which starts
+// from root, pwd or ~ like ResolvePath. Each component is matched with
+// path.Match, and a "**" component matches any number of directories.
+// As in sh, wildcards don't match names starting with a dot unless the
+// pattern does. Matches come back sorted, written relative to the same
+// place as the pattern.
+func GlobPaths(root *FsEntry, pwd *FsEntry, pattern string) []string {
+	dir, sofar, rest := pwd, "", pattern
+	if strings.HasPrefix(pattern, "/") {
+		dir, sofar = root, "/"
+	} else if pattern == "~" || strings.HasPrefix(pattern, "~/") {
+		dir = SnapshotRoot(pwd)
+		if dir == nil {
+			return nil
+		}
+		sofar, rest = "~/", strings.TrimPrefix(pattern, "~")
+	}
+	parts := []string{}
+	for _, part := range strings.Split(rest, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	found := make(map[string]bool)
+	globHelper(root, dir, sofar, parts, found)
+	matches := []string{}
+	for m := range found {
+		matches = append(matches, m)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func globHelper(root *FsEntry, dir *FsEntry, sofar string, parts []string, found map[string]bool) {
+	if len(parts) == 0 {
+		if sofar != "/" {
+			sofar = strings.TrimSuffix(sofar, "/")
+		}
+		found[sofar] = true
+		return
+	}
+	if dir.file {
+		return
+	}
+	part := parts[0]
+
+	if part == "**" {
+		globHelper(root, dir, sofar, parts[1:], found)
+		for _, kid := range ListDir(dir) {
+			if !kid.file && !strings.HasPrefix(kid.name, ".") {
+				globHelper(root, kid, sofar+kid.name+"/", parts, found)
+			}
+		}
+		return
+	}
+
+	if !hasMeta(part) {
+		name := unescape(part)
+		kid := LookupPath(dir, name)
+		if name == ".." && dir == root {
+			kid = root
+		}
+		if kid != nil {
+			globHelper(root, kid, sofar+name+"/", parts[1:], found)
+		}
+		return
+	}
+
+	for _, kid := range ListDir(dir) {
+		if strings.HasPrefix(kid.name, ".") && !strings.HasPrefix(part, ".") {
+			continue
+		}
+		if ok, _ := path.Match(part, kid.name); ok {
+			globHelper(root, kid, sofar+kid.name+"/", parts[1:], found)
+		}
+	}
+}
+
+// ExpandWords turns the words of a command line into arguments, replacing
+// each word with wildcards by what it matches. A pattern that matches
+// nothing is passed on as it is, so the command can say it wasn't found.
+func ExpandWords(root *FsEntry, pwd *FsEntry, words []shellWord) []string {
+	args := []string{}
+	for i, w := range words {
+		if i == 0 || !w.glob {
+			args = append(args, w.text)
+			continue
+		}
+		matches := GlobPaths(root, pwd, w.pattern)
+		if len(matches) == 0 {
+			args = append(args, w.text)
+		}
+		args = append(args, matches...)
+	}
+	return args
+}
+
+// MatchPath says whether the slash separated path p matches pattern,
+// component by component with path.Match, where a "**" component matches
+// any number of directories. A pattern that doesn't start with / can match
+// at any depth, so "src/*.go" matches /home/me/src/main.go.
+func MatchPath(pattern string, p string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchParts(splitPath(pattern), splitPath(p))
+}
+
+func splitPath(p string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(p, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func matchParts(pattern []string, p []string) bool {
+	if len(pattern) == 0 {
+		return len(p) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(p); i++ {
+			if matchParts(pattern[1:], p[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], p[0])
+	return ok && matchParts(pattern[1:], p[1:])
+}
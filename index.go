@@ -0,0 +1,355 @@
+package dumpy
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexEntry is what the local index keeps about each path in a snapshot:
+// enough to search and compare snapshots without their manifests.
+type IndexEntry struct {
+	Path       string // as in the manifest; directories end in /
+	Size       int64
+	ModTime    time.Time
+	Mode       os.FileMode
+	Uid        uint32
+	Gid        uint32
+	ContentId  string `json:",omitempty"`
+	LinkTarget string `json:",omitempty"`
+}
+
+// IndexDir is where indexes of bucket's snapshots are kept,
+// ~/.cache/dumpy/<bucket> on Linux.
+func IndexDir(bucket string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "dumpy", bucket)
+}
+
+// ListSnapshots gives the id (host/date) of every snapshot in the bucket,
+// sorted by host and then by when each was written, oldest first. The ids
+// alone can't be sorted: they only have a 12 hour clock.
+func ListSnapshots(bucket string) []string {
+	snapshots := []string{}
+	for _, s := range listSnapshotInfo(bucket) {
+		snapshots = append(snapshots, s.Name)
+	}
+	return snapshots
+}
+
+// listSnapshotInfo is ListSnapshots with the ObjectInfo of each snapshot's
+// manifest, named by snapshot id.
+func listSnapshotInfo(bucket string) []ObjectInfo {
+	snapshots := []ObjectInfo{}
+	for md := range ListMetadataInfo(bucket) {
+		id := strings.TrimSuffix(strings.TrimPrefix(md.Name, "/metadata/"), "/backup.json")
+		if strings.Count(id, "/") == 1 {
+			md.Name = id
+			snapshots = append(snapshots, md)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if path.Dir(a.Name) != path.Dir(b.Name) {
+			return path.Dir(a.Name) < path.Dir(b.Name)
+		}
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+		return a.Name < b.Name
+	})
+	return snapshots
+}
+
+// SnapshotTime gives the time in a snapshot id's date. Ids are written
+// with a 12 hour clock and no AM/PM, so the hour may be 12 hours early.
+// The -2, -3, ... of later snapshots in the same minute is ignored.
+func SnapshotTime(snapshot string) (time.Time, error) {
+	date := path.Base(snapshot)
+	if i := strings.LastIndex(date, "-"); i > len("2006-01-02") {
+		date = date[:i]
+	}
+	return time.ParseInLocation("2006-01-02@03:04", date, time.Local)
+}
+
+// indexEntries turns a manifest into index entries, sorted by path.
+func indexEntries(files map[string][]Chunk) []IndexEntry {
+	entries := make([]IndexEntry, 0, len(files))
+	for p, chunks := range files {
+		e := IndexEntry{
+			Path:       p,
+			Size:       chunks[0].FileSize,
+			ModTime:    chunks[0].FileModTime,
+			Mode:       chunks[0].FilePerm,
+			Uid:        chunks[0].Uid,
+			Gid:        chunks[0].Gid,
+			LinkTarget: chunks[0].LinkTarget,
+		}
+		if !strings.HasSuffix(p, "/") {
+			e.ContentId = FileContentID(chunks)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// indexHeader starts every cached index. It records which generation of
+// the manifest the index was built from: a later backup in the same minute
+// of the 12 hour clock rewrites the manifest under the same id.
+type indexHeader struct {
+	Generation int64
+}
+
+// LoadIndex gives the index of one snapshot. The index is built from the
+// manifest and kept in IndexDir, and read from there for as long as the
+// manifest in the bucket is the same generation.
+func LoadIndex(bucket string, snapshot string) []IndexEntry {
+	md, err := StatObject(bucket, SnapshotMetadata(snapshot))
+	if err != nil {
+		log.Fatal("Can't find snapshot ", snapshot, ": ", err)
+	}
+	return loadIndex(bucket, snapshot, md.Generation)
+}
+
+func loadIndex(bucket string, snapshot string, generation int64) []IndexEntry {
+	cached := filepath.Join(IndexDir(bucket), filepath.FromSlash(snapshot)+".json")
+	if entries, err := readIndex(cached, generation); err == nil {
+		return entries
+	}
+
+	// If the manifest is rewritten after it was stat'd, what's read is
+	// newer than generation, and it is only rebuilt again next time.
+	entries := indexEntries(ReadManifest(bucket, SnapshotMetadata(snapshot)))
+	err := writeIndex(cached, generation, entries)
+	if err != nil {
+		// Only slower next time.
+		log.Println("Can't cache index of ", snapshot, ": ", err)
+	}
+	return entries
+}
+
+func readIndex(name string, generation int64) ([]IndexEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []IndexEntry{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var hdr indexHeader
+	err = dec.Decode(&hdr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Generation != generation {
+		return nil, fmt.Errorf("index of generation %d, manifest is %d", hdr.Generation, generation)
+	}
+	for {
+		var e IndexEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// writeIndex writes under a temporary name and renames, so a reader never
+// sees half an index.
+func writeIndex(name string, generation int64, entries []IndexEntry) error {
+	err := os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(indexHeader{generation})
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(e)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// SnapshotFilter picks snapshots by host and by date. Zero values match
+// everything.
+type SnapshotFilter struct {
+	Host   string
+	After  time.Time // inclusive
+	Before time.Time // exclusive
+}
+
+// AddFlags registers -after and -before on a flag set. Hosts are left to
+// the caller, since the command line already has a -host.
+func (f *SnapshotFilter) AddFlags(fs *flag.FlagSet) {
+	fs.Func("after", "Only snapshots from this date on (2006-01-02 [15:04])", func(s string) (err error) {
+		f.After, err = ParseDate(s)
+		return err
+	})
+	fs.Func("before", "Only snapshots from before this date (2006-01-02 [15:04])", func(s string) (err error) {
+		f.Before, err = ParseDate(s)
+		return err
+	})
+}
+
+func (f SnapshotFilter) Match(snapshot string) bool {
+	if f.Host != "" && path.Dir(snapshot) != f.Host {
+		return false
+	}
+	if f.After.IsZero() && f.Before.IsZero() {
+		return true
+	}
+	t, err := SnapshotTime(snapshot)
+	if err != nil {
+		return false
+	}
+	if !f.After.IsZero() && t.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !t.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// ParseDate reads a -after or -before date, "2006-01-02" or
+// "2006-01-02 15:04", in local time. "" is the zero time.
+func ParseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse date %q; use 2006-01-02 or \"2006-01-02 15:04\"", s)
+}
+
+// LoadIndexes reads the index of every snapshot that f matches, keyed by
+// snapshot id. Indexes that aren't cached yet are built in parallel.
+func LoadIndexes(bucket string, f SnapshotFilter) map[string][]IndexEntry {
+	return loadIndexes(bucket, matchingSnapshots(bucket, f))
+}
+
+// matchingSnapshots lists the snapshots f matches, in ListSnapshots order.
+func matchingSnapshots(bucket string, f SnapshotFilter) []ObjectInfo {
+	ret := []ObjectInfo{}
+	for _, s := range listSnapshotInfo(bucket) {
+		if f.Match(s.Name) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func loadIndexes(bucket string, snapshots []ObjectInfo) map[string][]IndexEntry {
+	snaps := make(chan ObjectInfo)
+	var mu sync.Mutex
+	indexes := make(map[string][]IndexEntry)
+	var wg sync.WaitGroup
+	wg.Add(50)
+	for i := 0; i < 50; i++ {
+		go func() {
+			for s := range snaps {
+				entries := loadIndex(bucket, s.Name, s.Generation)
+				mu.Lock()
+				indexes[s.Name] = entries
+				mu.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	// The listing has every manifest's generation, so nothing needs to
+	// be stat'd one at a time.
+	for _, s := range snapshots {
+		snaps <- s
+	}
+	close(snaps)
+	wg.Wait()
+	return indexes
+}
+
+// FindResult is a path found in a snapshot.
+type FindResult struct {
+	Snapshot string
+	IndexEntry
+}
+
+// FindFiles searches the snapshots f matches for pattern. A pattern with a
+// slash in it is matched against the whole path (see MatchPath); one
+// without is matched against the last element only, like find -name.
+// Results are sorted by path, then snapshot.
+func FindFiles(bucket string, f SnapshotFilter, pattern string) ([]FindResult, error) {
+	if _, err := path.Match(strings.Replace(pattern, "**", "*", -1), ""); err != nil {
+		return nil, err
+	}
+	results := []FindResult{}
+	for snap, entries := range LoadIndexes(bucket, f) {
+		for _, e := range entries {
+			p := strings.TrimSuffix(e.Path, "/")
+			var ok bool
+			if strings.Contains(pattern, "/") {
+				ok = MatchPath(pattern, p)
+			} else {
+				ok, _ = path.Match(pattern, path.Base(p))
+			}
+			if ok {
+				results = append(results, FindResult{snap, e})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Path != results[j].Path {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].Snapshot < results[j].Snapshot
+	})
+	return results, nil
+}
+
+// PrintFindResults writes one line per result, with the path in the tree
+// (/host/date/...) so it can be pasted into the shell.
+func PrintFindResults(w io.Writer, results []FindResult) {
+	for _, r := range results {
+		size := ""
+		if !strings.HasSuffix(r.Path, "/") {
+			size = fmt.Sprint(r.Size)
+		}
+		fmt.Fprintf(w, "%12s  %s  /%s%s\n", size, r.ModTime.Format("2006-01-02 15:04"), r.Snapshot, r.Path)
+	}
+}
@@ -0,0 +1,110 @@
+package dumpy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// FileContentID identifies a file's contents: the hash of its chunk IDs in
+// offset order (or of the target, for a symlink).
+func FileContentID(chunks []Chunk) string {
+	if chunks[0].LinkTarget != "" {
+		csum := md5.Sum([]byte("link:" + chunks[0].LinkTarget))
+		return hex.EncodeToString(csum[:])
+	}
+	h := md5.New()
+	for _, c := range sortChunks(chunks) {
+		h.Write([]byte(c.Md5sum))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type JournalEntry struct {
+	Path      string // where the file belongs
+	Local     string // where it was written (differs when keeping both)
+	Size      int64
+	ContentId string
+}
+
+// RestoreJournal is an append-only log of files that have been completely
+// restored, so an interrupted restore can be re-run and pick up where it
+// stopped.
+type RestoreJournal struct {
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	done map[string]JournalEntry
+}
+
+// OpenRestoreJournal reads any entries left by a previous run and opens the
+// journal for appending.
+func OpenRestoreJournal(path string) *RestoreJournal {
+	j := &RestoreJournal{done: make(map[string]JournalEntry)}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatal("Can't open journal ", path, ": ", err)
+	}
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e JournalEntry
+		err := dec.Decode(&e)
+		if err != nil {
+			// Most likely the last line was cut short by whatever
+			// interrupted us. Anything after it is lost, which only
+			// means re-checking those files.
+			log.Println("Journal ", path, " truncated: ", err)
+			break
+		}
+		j.done[e.Path] = e
+	}
+	j.f = f
+	j.enc = json.NewEncoder(f)
+	return j
+}
+
+// Done reports whether p was already restored with these contents and still
+// looks that way on disk. A nil journal has nothing done.
+func (j *RestoreJournal) Done(p string, chunks []Chunk) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	e, ok := j.done[p]
+	j.mu.Unlock()
+	if !ok || e.Size != chunks[0].FileSize || e.ContentId != FileContentID(chunks) {
+		return false
+	}
+	st, err := os.Lstat(e.Local)
+	if err != nil {
+		return false
+	}
+	if chunks[0].LinkTarget != "" {
+		return st.Mode()&os.ModeSymlink != 0
+	}
+	return st.Mode().IsRegular() && st.Size() == e.Size
+}
+
+func (j *RestoreJournal) Record(p string, local string, chunks []Chunk) {
+	if j == nil {
+		return
+	}
+	e := JournalEntry{p, local, chunks[0].FileSize, FileContentID(chunks)}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done[p] = e
+	err := j.enc.Encode(e)
+	if err != nil {
+		log.Fatal("Error writing journal: ", err)
+	}
+}
+
+func (j *RestoreJournal) Close() {
+	if j == nil {
+		return
+	}
+	j.f.Close()
+}
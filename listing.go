@@ -0,0 +1,253 @@
+package dumpy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ListOptions control how the shell's ls prints a directory.
+type ListOptions struct {
+	Long    bool
+	Human   bool
+	BySize  bool
+	ByTime  bool
+	Reverse bool
+}
+
+func (o *ListOptions) AddFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Long, "l", false, "Long listing: mode, uid/gid, size, mtime, link target")
+	fs.BoolVar(&o.Human, "h", false, "Human readable sizes")
+	fs.BoolVar(&o.BySize, "S", false, "Sort by size, largest first")
+	fs.BoolVar(&o.ByTime, "t", false, "Sort by modification time, newest first")
+	fs.BoolVar(&o.Reverse, "r", false, "Reverse the sort order")
+}
+
+// SplitShortFlags turns "-lh" into "-l -h", the way ls users type them.
+// Only arguments made entirely of known one letter bool flags are split.
+func SplitShortFlags(fs *flag.FlagSet, args []string) []string {
+	ret := []string{}
+	for _, arg := range args {
+		if len(arg) < 3 || arg[0] != '-' || arg[1] == '-' {
+			ret = append(ret, arg)
+			continue
+		}
+		letters := arg[1:]
+		known := true
+		for _, l := range letters {
+			if fs.Lookup(string(l)) == nil {
+				known = false
+				break
+			}
+		}
+		if !known {
+			ret = append(ret, arg)
+			continue
+		}
+		for _, l := range letters {
+			ret = append(ret, "-"+string(l))
+		}
+	}
+	return ret
+}
+
+// SortEntries orders entries for ls. ListDir has already sorted them by
+// name, which is kept as the tie breaker.
+func SortEntries(entries []*FsEntry, opts ListOptions) {
+	less := func(i, j int) bool { return false }
+	if opts.BySize {
+		less = func(i, j int) bool { return EntryInfo(entries[i]).Size() > EntryInfo(entries[j]).Size() }
+	} else if opts.ByTime {
+		less = func(i, j int) bool { return EntryInfo(entries[i]).ModTime().After(EntryInfo(entries[j]).ModTime()) }
+	}
+	sort.SliceStable(entries, less)
+	if opts.Reverse {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+}
+
+func formatSize(n int64, human bool) string {
+	if human {
+		return humanize.Bytes(uint64(n))
+	}
+	return fmt.Sprint(n)
+}
+
+// WriteLong prints one line per entry with the metadata from its first
+// chunk. Directories have none, so they only get a mode and a name.
+func WriteLong(w io.Writer, entries []*FsEntry, human bool) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	for _, e := range entries {
+		info := EntryInfo(e)
+		if !e.file || len(e.chunks) == 0 {
+			fmt.Fprintf(tw, "%s\t\t\t\t\t %s\n", info.Mode(), FormatFilename(e))
+			continue
+		}
+		c := e.chunks[0]
+		name := e.name
+		if c.LinkTarget != "" {
+			name += " -> " + c.LinkTarget
+		}
+		fmt.Fprintf(tw, "%s\t %d\t %d\t %s\t %s\t %s\n", info.Mode(), c.Uid, c.Gid,
+			formatSize(info.Size(), human), info.ModTime().Format("2006-01-02 15:04"), name)
+	}
+	tw.Flush()
+}
+
+// WriteShort prints bare names in 80 column rows.
+func WriteShort(w io.Writer, entries []*FsEntry) {
+	line := ""
+	for _, f := range entries {
+		fname := FormatFilename(f)
+		if (len(line) + len(fname) + 1) >= 80 {
+			io.WriteString(w, strings.TrimRight(line, " ")+"\r\n")
+			line = ""
+		}
+		line = line + fname + " "
+	}
+	if len(line) > 0 {
+		io.WriteString(w, strings.TrimRight(line, " ")+"\r\n")
+	}
+}
+
+// ChunkUses counts how many times each chunk appears in the files under
+// dir.
+func ChunkUses(dir *FsEntry) map[string]int {
+	uses := make(map[string]int)
+	Walk(dir, 1<<30, func(e *FsEntry, path []*FsEntry) {
+		if !e.file || len(e.chunks) == 0 || e.chunks[0].LinkTarget != "" {
+			return
+		}
+		for _, c := range e.chunks {
+			uses[c.Md5sum]++
+		}
+	})
+	return uses
+}
+
+// WriteStat describes e in detail: its metadata, content ID and every
+// chunk, with how often the chunk is used in the same snapshot (uses, from
+// ChunkUses). A chunk used more than once is stored only once.
+func WriteStat(w io.Writer, path string, e *FsEntry, uses map[string]int) {
+	info := EntryInfo(e)
+	fmt.Fprintf(w, "  Path: %s\n", path)
+	if !e.file {
+		fmt.Fprintf(w, "  Type: directory\n")
+		fmt.Fprintf(w, "  Entries: %d\n", len(ListDir(e)))
+		return
+	}
+	c := e.chunks[0]
+	if c.LinkTarget != "" {
+		fmt.Fprintf(w, "  Type: symlink -> %s\n", c.LinkTarget)
+	} else {
+		fmt.Fprintf(w, "  Type: file\n")
+	}
+	fmt.Fprintf(w, "  Size: %d (%s)\n", info.Size(), humanize.Bytes(uint64(info.Size())))
+	fmt.Fprintf(w, "  Mode: %s  Uid: %d  Gid: %d\n", info.Mode(), c.Uid, c.Gid)
+	fmt.Fprintf(w, "  Modified: %s\n", info.ModTime().Format("2006-01-02 15:04:05 -0700"))
+	fmt.Fprintf(w, "  Content: %s\n", FileContentID(e.chunks))
+	if c.LinkTarget != "" {
+		return
+	}
+
+	shared := int64(0)
+	fmt.Fprintf(w, "  Chunks: %d\n", len(e.chunks))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "    offset\tsize\tmd5\tuses\n")
+	for _, c := range sortChunks(e.chunks) {
+		n := uses[c.Md5sum]
+		status := fmt.Sprint(n)
+		if n > 1 {
+			status += " (deduplicated)"
+			shared += chunkSize(c)
+		}
+		fmt.Fprintf(tw, "    %d\t%d\t%s\t%s\n", c.Offset, chunkSize(c), c.Md5sum, status)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "  Shared: %s of %s\n", humanize.Bytes(uint64(shared)), humanize.Bytes(uint64(info.Size())))
+}
+
+// Usage is what a subtree holds: how many files (and symlinks), their
+// total size, and the bytes left once chunks shared between them are
+// counted once, which is what restoring it downloads.
+type Usage struct {
+	Files   int
+	Logical int64
+	Unique  int64
+}
+
+// usageCounter adds files up into a Usage, counting each chunk's bytes in
+// Unique only the first time it is seen.
+type usageCounter struct {
+	u    Usage
+	seen map[string]bool
+}
+
+func (uc *usageCounter) add(f *FsEntry) {
+	if !f.file || len(f.chunks) == 0 {
+		return
+	}
+	uc.u.Files++
+	if f.chunks[0].LinkTarget != "" {
+		return
+	}
+	uc.u.Logical += f.chunks[0].FileSize
+	if uc.seen == nil {
+		uc.seen = make(map[string]bool)
+	}
+	for _, c := range f.chunks {
+		if !uc.seen[c.Md5sum] {
+			uc.seen[c.Md5sum] = true
+			uc.u.Unique += chunkSize(c)
+		}
+	}
+}
+
+// TreeUsage adds up the usage of everything under e.
+func TreeUsage(e *FsEntry) Usage {
+	var uc usageCounter
+	if e.file {
+		uc.add(e)
+		return uc.u
+	}
+	Walk(e, 1<<30, func(f *FsEntry, path []*FsEntry) { uc.add(f) })
+	return uc.u
+}
+
+// ChildUsage gives the TreeUsage of directory e and of each directory in it,
+// keyed by name, from a single walk.
+func ChildUsage(e *FsEntry) (Usage, map[string]Usage) {
+	var total usageCounter
+	kids := make(map[string]*usageCounter)
+	Walk(e, 1<<30, func(f *FsEntry, path []*FsEntry) {
+		total.add(f)
+		dir := f
+		if len(path) > 0 {
+			dir = path[0]
+		}
+		if dir.file {
+			return
+		}
+		if kids[dir.name] == nil {
+			kids[dir.name] = &usageCounter{}
+		}
+		kids[dir.name].add(f)
+	})
+	ret := make(map[string]Usage)
+	for name, uc := range kids {
+		ret[name] = uc.u
+	}
+	return total.u, ret
+}
+
+// WriteUsage prints one line of du output.
+func WriteUsage(w io.Writer, u Usage, name string, human bool) {
+	fmt.Fprintf(w, "%8d files  %10s  %10s unique  %s\n", u.Files, formatSize(u.Logical, human), formatSize(u.Unique, human), name)
+}
@@ -0,0 +1,773 @@
+package dumpy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// SnapshotMetadata maps a snapshot id ("host/2006-01-02@03:04") to the
+// name of its manifest in the bucket. Full metadata paths are passed through.
+func SnapshotMetadata(snapshot string) string {
+	if strings.HasPrefix(snapshot, "/metadata/") {
+		return snapshot
+	}
+	return "/metadata/" + strings.Trim(snapshot, "/") + "/backup.json"
+}
+
+// ReadManifest decodes a backup.json and groups its chunks by file.
+func ReadManifest(bucket string, metadata string) map[string][]Chunk {
+	files := make(map[string][]Chunk)
+	r := GetReader(bucket, metadata)
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var c Chunk
+		err := dec.Decode(&c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files[c.Path] = append(files[c.Path], c)
+	}
+	r.Close()
+	return files
+}
+
+// What to do when a file being restored already exists.
+const (
+	OverwriteSkip    = "skip"     // leave the existing file alone
+	OverwriteAlways  = "always"   // replace it
+	OverwriteChanged = "changed"  // replace it if size, mtime or contents differ
+	OverwriteKeep    = "keepboth" // restore next to it under a new name
+)
+
+// RestoreOptions controls where restored files end up.
+type RestoreOptions struct {
+	Target    string // directory to restore under; "" means the current directory
+	InPlace   bool   // restore to the original absolute paths
+	Strip     string // prefix removed from each path before it is placed
+	Overwrite string // one of the Overwrite* policies; "" means skip
+	SyncDirs  bool   // fsync each directory after renaming a file into it
+	Journal   string // file recording finished files, for resuming
+	CacheMB   int64  // memory for chunks used by more than one file
+	Chown     bool
+	DryRun    bool // only list what would be written
+	Verbose   bool // print each directory as it is finished
+
+	journal *RestoreJournal
+}
+
+// AddFlags registers the restore options on a flag set, using the current
+// values as defaults. Shared by the command line and the shell. -n and -v
+// are left to AddRunFlags.
+func (o *RestoreOptions) AddFlags(fs *flag.FlagSet) {
+	if o.Overwrite == "" {
+		o.Overwrite = OverwriteSkip
+	}
+	if o.CacheMB == 0 {
+		o.CacheMB = 256
+	}
+	fs.StringVar(&o.Target, "target", o.Target, "Directory to restore into")
+	fs.BoolVar(&o.InPlace, "inplace", o.InPlace, "Restore to the original absolute paths")
+	fs.StringVar(&o.Strip, "strip", o.Strip, "Path prefix to remove before restoring")
+	fs.StringVar(&o.Overwrite, "overwrite", o.Overwrite, "Existing files: skip|always|changed|keepboth")
+	fs.BoolVar(&o.SyncDirs, "syncdirs", o.SyncDirs, "fsync directories after each restored file")
+	fs.StringVar(&o.Journal, "journal", o.Journal, "Journal of restored files; re-run with the same journal to resume")
+	fs.Int64Var(&o.CacheMB, "cachemb", o.CacheMB, "MB of memory for caching shared chunks (the rest spill to disk)")
+}
+
+// AddRunFlags registers -n and -v, which only mean something where a
+// restore is actually run: restore mode and the shell's restore commands.
+func (o *RestoreOptions) AddRunFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.DryRun, "n", o.DryRun, "Dry run: list what would be written, and do nothing")
+	fs.BoolVar(&o.Verbose, "v", o.Verbose, "Print each directory as its last file is restored")
+}
+
+// openJournal opens the journal named by the options, if any. Callers must
+// closeJournal when the restore is over.
+func (o *RestoreOptions) openJournal() {
+	if o.Journal != "" {
+		o.journal = OpenRestoreJournal(o.Journal)
+	}
+}
+
+func (o *RestoreOptions) closeJournal() {
+	o.journal.Close()
+	o.journal = nil
+}
+
+// Check rejects option combinations that make no sense.
+func (o *RestoreOptions) Check() error {
+	if o.InPlace && o.Target != "" {
+		return fmt.Errorf("-inplace and -target are mutually exclusive")
+	}
+	if o.InPlace && o.Strip != "" {
+		// Stripping would move files away from the paths -inplace is for.
+		return fmt.Errorf("-inplace and -strip are mutually exclusive")
+	}
+	switch o.Overwrite {
+	case "", OverwriteSkip, OverwriteAlways, OverwriteChanged, OverwriteKeep:
+	default:
+		return fmt.Errorf("unknown -overwrite policy %q", o.Overwrite)
+	}
+	return nil
+}
+
+// LocalPath maps a path from the manifest to the place it is restored to.
+func (o *RestoreOptions) LocalPath(p string) string {
+	// Clean against the root first so nothing in a manifest can climb out
+	// of the target directory.
+	p = path.Clean("/" + p)
+	if o.Strip != "" {
+		strip := path.Clean("/" + o.Strip)
+		if p == strip {
+			p = "/"
+		} else if strings.HasPrefix(p, strip+"/") {
+			p = strings.TrimPrefix(p, strip)
+		}
+	}
+	if o.InPlace {
+		return p
+	}
+	target := o.Target
+	if target == "" {
+		target = "."
+	}
+	return filepath.Join(target, p)
+}
+
+// RestoreReport tallies what a restore did. It is shared by all the
+// restore workers.
+type RestoreReport struct {
+	mu         sync.Mutex
+	Files      int
+	Links      int
+	Dirs       int
+	Bytes      int64
+	Downloaded int64 // unique bytes fetched from the bucket
+	Resumed    int   // files finished by an earlier run
+	Skipped    []string
+	Replaced   []string
+	Renamed    []string
+	Failed     []string
+}
+
+func (r *RestoreReport) record(outcome string, orig string, local string, chunks []Chunk, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch outcome {
+	case "skipped":
+		r.Skipped = append(r.Skipped, local)
+		return
+	case "failed":
+		r.Failed = append(r.Failed, local)
+		return
+	case "resumed":
+		r.Resumed++
+		return
+	case "replaced":
+		r.Replaced = append(r.Replaced, local)
+	case "renamed":
+		r.Renamed = append(r.Renamed, orig+" -> "+local)
+	}
+	if chunks[0].LinkTarget != "" {
+		r.Links++
+	} else {
+		r.Files++
+		r.Bytes += bytes
+	}
+}
+
+// Ok is true if nothing failed.
+func (r *RestoreReport) Ok() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Failed) == 0
+}
+
+// Print writes the totals followed by every file that was not simply
+// restored.
+func (r *RestoreReport) Print(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "Restored %d files (%s), %d symlinks, %d directories\n",
+		r.Files, humanize.Bytes(uint64(r.Bytes)), r.Links, r.Dirs)
+	fmt.Fprintf(w, "Downloaded %s for %s restored\n",
+		humanize.Bytes(uint64(r.Downloaded)), humanize.Bytes(uint64(r.Bytes)))
+	if r.Resumed > 0 {
+		fmt.Fprintf(w, "%d files were already restored by an earlier run\n", r.Resumed)
+	}
+	lists := []struct {
+		title string
+		paths []string
+	}{
+		{"Skipped existing", r.Skipped},
+		{"Replaced", r.Replaced},
+		{"Kept both", r.Renamed},
+		{"FAILED", r.Failed},
+	}
+	for _, l := range lists {
+		if len(l.paths) == 0 {
+			continue
+		}
+		sort.Strings(l.paths)
+		fmt.Fprintf(w, "%s (%d):\n", l.title, len(l.paths))
+		for _, p := range l.paths {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+}
+
+func RestoreOneChunk(f *os.File, c Chunk) {
+	n, err := f.WriteAt(c.data, c.Offset)
+	if err != nil || n != len(c.data) {
+		log.Fatal("error writing to ", f.Name(), " ", err)
+	}
+}
+
+func FixPermAndTimes(path string, chown bool, c Chunk) {
+	err := os.Chmod(path, c.FilePerm)
+	if err != nil {
+		log.Fatal("Error chmod'ing: ", err)
+	}
+	if chown {
+		err = os.Chown(path, (int)(c.Uid), (int)(c.Gid))
+		if err != nil {
+			log.Fatal("Error changing owner to ", c.Uid, " ", c.Gid, ": ", err)
+		}
+	}
+	err = os.Chtimes(path, c.FileModTime, c.FileModTime)
+	if err != nil {
+		log.Fatal("Error changing access times: ", err)
+	}
+}
+
+// How many chunks of a file may be downloaded ahead of the one being
+// written.
+const readahead = 4
+
+// sortChunks returns a copy of chunks in offset order.
+func sortChunks(chunks []Chunk) []Chunk {
+	sorted := make([]Chunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	return sorted
+}
+
+// chunkSize is the number of bytes c covers in its file.
+func chunkSize(c Chunk) int64 {
+	return min(1<<20, c.FileSize-c.Offset)
+}
+
+// fetchChunk downloads a chunk and checks it against its content ID. Bad or
+// failed downloads are retried a few times before giving up, so a corrupt
+// object in the bucket turns into an error rather than a wrong file.
+func fetchChunk(bucket string, c Chunk) ([]byte, error) {
+	var err error
+	for try := 0; try < 3; try++ {
+		if try > 0 {
+			log.Println("Chunk ", c.Md5sum, " of ", c.Path, ": ", err, ", retrying")
+			time.Sleep(2 * time.Second)
+		}
+		var data []byte
+		data, err = tryReadObject(bucket, c.Md5sum)
+		if err != nil {
+			continue
+		}
+		if int64(len(data)) != chunkSize(c) {
+			err = fmt.Errorf("chunk %s has %d bytes, expected %d", c.Md5sum, len(data), chunkSize(c))
+			continue
+		}
+		csum := md5.Sum(data)
+		if hex.EncodeToString(csum[:]) != c.Md5sum {
+			err = fmt.Errorf("chunk %s is corrupt (hashes to %x)", c.Md5sum, csum)
+			continue
+		}
+		return data, nil
+	}
+	return nil, err
+}
+
+// LocalMatches reports whether the file at p already has the contents and
+// metadata described by chunks. Size and mtime are checked first, so the
+// (expensive) hash comparison only happens when they agree.
+func LocalMatches(p string, chunks []Chunk) bool {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return false
+	}
+	if chunks[0].LinkTarget != "" {
+		target, err := os.Readlink(p)
+		return err == nil && target == chunks[0].LinkTarget
+	}
+	if !st.Mode().IsRegular() || st.Size() != chunks[0].FileSize ||
+		!st.ModTime().Equal(chunks[0].FileModTime) {
+		return false
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	for _, c := range chunks {
+		if !hasChunk(f, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveConflict applies the overwrite policy to p. It returns the path to
+// write and what will happen to it: "restored", "replaced", "renamed" or
+// "skipped".
+func resolveConflict(p string, policy string, chunks []Chunk) (string, string, error) {
+	st, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return p, "restored", nil
+	}
+	if err != nil {
+		return p, "", err
+	}
+	if st.IsDir() {
+		log.Println("Not replacing directory ", p, " with a file")
+		return p, "skipped", nil
+	}
+
+	switch policy {
+	case OverwriteAlways:
+		return p, "replaced", nil
+	case OverwriteChanged:
+		if LocalMatches(p, chunks) {
+			return p, "skipped", nil
+		}
+		return p, "replaced", nil
+	case OverwriteKeep:
+		for i := 1; ; i++ {
+			q := p + ".restored"
+			if i > 1 {
+				q = fmt.Sprintf("%s.restored-%d", p, i)
+			}
+			if _, err := os.Lstat(q); os.IsNotExist(err) {
+				return q, "renamed", nil
+			}
+		}
+	}
+	return p, "skipped", nil
+}
+
+// restoreJob is what every file of one restore shares.
+type restoreJob struct {
+	opts     *RestoreOptions
+	cache    *ChunkCache
+	report   *RestoreReport
+	progress chan Progress
+	dirs     *dirProgress // nil unless opts.Verbose
+}
+
+// dirProgress counts down the files left in each directory of a restore
+// and reports a directory on finished once its last file is done.
+type dirProgress struct {
+	mu       sync.Mutex
+	left     map[string]int
+	total    map[string]int
+	finished chan string
+}
+
+func newDirProgress(files [][]Chunk) *dirProgress {
+	d := &dirProgress{left: make(map[string]int), total: make(map[string]int), finished: make(chan string)}
+	for _, chunks := range files {
+		dir := path.Dir(chunks[0].Path)
+		d.left[dir]++
+		d.total[dir]++
+	}
+	return d
+}
+
+func (d *dirProgress) fileDone(p string) {
+	if d == nil {
+		return
+	}
+	dir := path.Dir(p)
+	d.mu.Lock()
+	d.left[dir]--
+	left, total := d.left[dir], d.total[dir]
+	d.mu.Unlock()
+	if left == 0 {
+		d.finished <- fmt.Sprintf("%s (%d files)", dir, total)
+	}
+}
+
+// skip gives back the planned cache uses of chunks that won't be read.
+func (job *restoreJob) skip(chunks []Chunk) {
+	if chunks[0].LinkTarget != "" {
+		return
+	}
+	for _, c := range chunks {
+		job.cache.Skip(c)
+	}
+}
+
+// restoreFile writes one file (all of its chunks) and records the outcome in
+// the job's report.
+func (job *restoreJob) restoreFile(chunks []Chunk) {
+	opts := job.opts
+	report := job.report
+	orig := opts.LocalPath(chunks[0].Path)
+	if opts.journal.Done(orig, chunks) {
+		job.skip(chunks)
+		report.record("resumed", orig, orig, chunks, 0)
+		return
+	}
+	if opts.journal != nil && LocalMatches(orig, chunks) {
+		// Finished by an earlier run that died before it got journaled.
+		job.skip(chunks)
+		opts.journal.Record(orig, orig, chunks)
+		report.record("resumed", orig, orig, chunks, 0)
+		return
+	}
+
+	p, outcome, err := resolveConflict(orig, opts.Overwrite, chunks)
+	if err != nil {
+		job.skip(chunks)
+		log.Println("Not restoring ", orig, ": ", err)
+		report.record("failed", orig, orig+": "+err.Error(), chunks, 0)
+		return
+	}
+	if outcome == "skipped" {
+		job.skip(chunks)
+		report.record(outcome, orig, p, chunks, 0)
+		return
+	}
+
+	// Check the chunks tile the file exactly before touching anything.
+	size := chunks[0].FileSize
+	chunks = sortChunks(chunks)
+	var bytes int64
+	bytes = 0
+	for _, c := range chunks {
+		if c.Path != chunks[0].Path {
+			log.Fatal("Chunk from file ", c.Path, " while restoring ", chunks[0].Path)
+		}
+		if c.FileSize != size {
+			log.Fatal("Mismatched sizes: ", c.FileSize, " vs ", size)
+		}
+		if c.Offset != bytes {
+			log.Fatal("Chunk at offset ", c.Offset, " of ", c.Path, ", expected ", bytes)
+		}
+		bytes += chunkSize(c)
+	}
+	if chunks[0].LinkTarget == "" && bytes != size {
+		log.Fatal("Missing chunks: ", bytes, " vs ", size)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		log.Fatal("Can't create dir ", filepath.Dir(p), ": ", err)
+	}
+
+	// Everything is written under a temporary name in the destination
+	// directory and renamed into place once it is complete, so an
+	// interrupted restore never leaves a partial file under the real name.
+	// The rename also takes care of replacing an existing file.
+	tmp := partialName(p)
+	if chunks[0].LinkTarget != "" {
+		// Symlinks have nothing worth downloading: their "chunk" is
+		// named after the link's path, not its contents.
+		os.Remove(tmp)
+		err := os.Symlink(chunks[0].LinkTarget, tmp)
+		if err != nil {
+			log.Fatal("Error symlinking: ", p, " --> ", chunks[0].LinkTarget, ": ", err)
+		}
+		bytes = 0
+	} else {
+		f := openPartial(tmp)
+
+		// Skip any chunks that an interrupted run already left in the
+		// partial file.
+		need := make([]Chunk, 0, len(chunks))
+		for _, c := range chunks {
+			if hasChunk(f, c) {
+				job.cache.Skip(c)
+				job.progress <- Progress{"restored", uint64(chunkSize(c))}
+			} else {
+				need = append(need, c)
+			}
+		}
+
+		// Stream the rest in: each chunk is written as soon as it
+		// arrives and then dropped, so memory doesn't grow with the
+		// size of the file.
+		fetched, stop := job.cache.Stream(need, readahead)
+		for fc := range fetched {
+			if fc.err != nil {
+				stop()
+				f.Close()
+				log.Println("Not restoring ", p, ": ", fc.err)
+				report.record("failed", orig, p+": "+fc.err.Error(), chunks, 0)
+				return
+			}
+			RestoreOneChunk(f, fc.c)
+			job.progress <- Progress{"restored", uint64(len(fc.c.data))}
+		}
+		err = f.Truncate(size)
+		if err != nil {
+			log.Fatal("Error truncating ", tmp, ": ", err)
+		}
+		err = f.Sync()
+		if err != nil {
+			log.Fatal("Error syncing ", tmp, ": ", err)
+		}
+		f.Close()
+
+		// Fix permissions _after_ writing everything out
+		// in case any files lack write permission (this causes
+		// multi-chunk files to error when we try to write the
+		// second chunk)
+		FixPermAndTimes(tmp, opts.Chown, chunks[0])
+	}
+
+	err = os.Rename(tmp, p)
+	if err != nil {
+		log.Fatal("Can't rename ", tmp, " to ", p, ": ", err)
+	}
+	if opts.SyncDirs {
+		syncDir(filepath.Dir(p))
+	}
+	opts.journal.Record(orig, p, chunks)
+	report.record(outcome, orig, p, chunks, bytes)
+}
+
+// openPartial opens tmp for writing, keeping whatever an earlier run left in
+// it.
+func openPartial(tmp string) *os.File {
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0777) // we'll fix up the perms later.
+	if err != nil {
+		// Probably made read-only by FixPermAndTimes just before the
+		// earlier run died. Start it over.
+		os.Remove(tmp)
+		f, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+		if err != nil {
+			log.Fatal("Error opening: ", err)
+		}
+	}
+	return f
+}
+
+// hasChunk reports whether f already holds c's contents at c's offset.
+func hasChunk(f *os.File, c Chunk) bool {
+	data := make([]byte, chunkSize(c))
+	_, err := f.ReadAt(data, c.Offset)
+	if err != nil {
+		return false
+	}
+	csum := md5.Sum(data)
+	return hex.EncodeToString(csum[:]) == c.Md5sum
+}
+
+// partialName is where p is written while it is being restored.
+func partialName(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".dumpy-partial")
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Fatal("Can't open ", dir, ": ", err)
+	}
+	err = d.Sync()
+	if err != nil {
+		log.Fatal("Error syncing ", dir, ": ", err)
+	}
+	d.Close()
+}
+
+// StartRestoreProgress prints how much of a restore is done: logical bytes
+// written against the total, and unique bytes downloaded against the total
+// after deduplication. Anything sent on dirs (which may be nil) is printed
+// on a line of its own above the totals.
+func StartRestoreProgress(logical int64, unique int64, dirs <-chan string) chan Progress {
+	var progress_channel = make(chan Progress)
+	go func() {
+		var restored_bytes uint64 = 0
+		var downloaded_bytes uint64 = 0
+
+		for {
+			select {
+			case p, ok := <-progress_channel:
+				if !ok {
+					fmt.Printf("\n")
+					return
+				}
+				if p.update_type == "restored" {
+					restored_bytes += p.update_value
+				} else if p.update_type == "downloaded" {
+					downloaded_bytes += p.update_value
+				}
+			case d := <-dirs:
+				fmt.Printf("\r Finished %-60s\n", d)
+			}
+			fmt.Printf("\r Restored %s of %s; Downloaded %s of %s unique           ",
+				humanize.Bytes(restored_bytes),
+				humanize.Bytes(uint64(logical)),
+				humanize.Bytes(downloaded_bytes),
+				humanize.Bytes(uint64(unique)))
+		}
+	}()
+	return progress_channel
+}
+
+// planRestore splits files into the ones to write, sorted by path, and the
+// directories they need.
+func planRestore(files [][]Chunk) ([][]Chunk, map[string]bool) {
+	todo := make([][]Chunk, 0, len(files))
+	dirs := make(map[string]bool)
+	for _, chunks := range files {
+		p := chunks[0].Path
+		d := path.Dir(p)
+		if strings.HasSuffix(p, "/") {
+			d = strings.TrimSuffix(p, "/")
+		} else {
+			todo = append(todo, chunks)
+		}
+		for ; d != "/" && d != "." && !dirs[d]; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	sort.Slice(todo, func(i, j int) bool { return todo[i][0].Path < todo[j][0].Path })
+	return todo, dirs
+}
+
+// DryRunRestore lists, without touching anything, exactly what restoring
+// files with opts would do: the directories it would create and what the
+// overwrite policy would do with each file. Files it can't decide about are
+// listed as errors.
+func DryRunRestore(w io.Writer, opts *RestoreOptions, files [][]Chunk) {
+	todo, dirs := planRestore(files)
+	sorted := []string{}
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	for _, d := range sorted {
+		if _, err := os.Stat(opts.LocalPath(d)); os.IsNotExist(err) {
+			fmt.Fprintf(w, "mkdir     %s\n", opts.LocalPath(d))
+		}
+	}
+
+	var bytes int64
+	written := 0
+	for _, chunks := range todo {
+		orig := opts.LocalPath(chunks[0].Path)
+		p, outcome, err := resolveConflict(orig, opts.Overwrite, chunks)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "error     %s: %v\n", orig, err)
+			continue
+		case outcome == "skipped":
+			fmt.Fprintf(w, "skip      %s (exists)\n", orig)
+			continue
+		case chunks[0].LinkTarget != "":
+			fmt.Fprintf(w, "%-9s %s -> %s\n", "link", p, chunks[0].LinkTarget)
+		case outcome == "renamed":
+			fmt.Fprintf(w, "keepboth  %s (%s)\n", p, humanize.Bytes(uint64(chunks[0].FileSize)))
+		case outcome == "replaced":
+			fmt.Fprintf(w, "replace   %s (%s)\n", p, humanize.Bytes(uint64(chunks[0].FileSize)))
+		default:
+			fmt.Fprintf(w, "write     %s (%s)\n", p, humanize.Bytes(uint64(chunks[0].FileSize)))
+		}
+		written++
+		if chunks[0].LinkTarget == "" {
+			bytes += chunks[0].FileSize
+		}
+	}
+	fmt.Fprintf(w, "Would write %d of %d files (%s)\n", written, len(todo), humanize.Bytes(uint64(bytes)))
+}
+
+// RestoreFiles restores a set of files (each one a list of its chunks) as a
+// single job: directories are created first, then every chunk the files
+// need is downloaded once and written wherever it is used. opts.DryRun is
+// the caller's to check: a dry run is DryRunRestore instead.
+func RestoreFiles(bucket string, opts *RestoreOptions, files [][]Chunk) *RestoreReport {
+	report := new(RestoreReport)
+	opts.openJournal()
+	defer opts.closeJournal()
+
+	// Directory entries only need to exist; everything else is a file or
+	// a symlink. Create all the directories up front so the workers don't
+	// race each other in MkdirAll.
+	todo, dirs := planRestore(files)
+	for d := range dirs {
+		err := os.MkdirAll(opts.LocalPath(d), 0777)
+		if err != nil {
+			log.Fatal("Can't create dir ", d, ": ", err)
+		}
+		report.Dirs++
+	}
+
+	cache := NewChunkCache(bucket, opts.CacheMB<<20)
+	defer cache.Close()
+	logical, unique := cache.Plan(todo)
+	job := &restoreJob{opts: opts, cache: cache, report: report}
+	var finished chan string
+	if opts.Verbose {
+		job.dirs = newDirProgress(todo)
+		finished = job.dirs.finished
+	}
+	job.progress = StartRestoreProgress(logical, unique, finished)
+	cache.progress = job.progress
+
+	c := make(chan []Chunk)
+	var wg sync.WaitGroup
+	wg.Add(50)
+	for i := 0; i < 50; i++ {
+		go func() {
+			for chunks := range c {
+				job.restoreFile(chunks)
+				job.dirs.fileDone(chunks[0].Path)
+			}
+			wg.Done()
+		}()
+	}
+
+	for _, chunks := range todo {
+		c <- chunks
+	}
+	close(c)
+	wg.Wait()
+	close(job.progress)
+
+	report.Downloaded = cache.Downloaded()
+	return report
+}
+
+// RestoreAll restores every file in a snapshot's manifest without any
+// interaction. opts decides where the files are written.
+func RestoreAll(bucket string, metadata string, opts *RestoreOptions) *RestoreReport {
+	files := make([][]Chunk, 0)
+	for _, chunks := range ReadManifest(bucket, metadata) {
+		files = append(files, chunks)
+	}
+	if opts.DryRun {
+		DryRunRestore(os.Stdout, opts, files)
+		return new(RestoreReport)
+	}
+	report := RestoreFiles(bucket, opts, files)
+
+	fmt.Printf("Restore of %s done.\n", metadata)
+	report.Print(os.Stdout)
+	return report
+}
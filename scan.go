@@ -1,24 +1,19 @@
 package dumpy
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	storage "cloud.google.com/go/storage"
 	"github.com/dustin/go-humanize"
-	terminal "golang.org/x/crypto/ssh/terminal"
 )
 
 // SRSLY?
@@ -41,6 +36,9 @@ type Chunk struct {
 	// only one of the below should be set:
 	data       []byte
 	LinkTarget string
+	// data was filled in by the source (e.g. a tar stream) rather than
+	// needing to be read from Path
+	filled bool
 }
 
 type Progress struct {
@@ -113,14 +111,21 @@ func walkDirectory(roots []string) chan Chunk {
 					} else {
 						var o int64
 						o = 0
-						for o < stat.Size() {
+						// Empty regular files get one empty chunk, so they
+						// are recorded too. Other empty entries (FIFOs,
+						// sockets, devices) are skipped: there is nothing to
+						// back up, and opening a FIFO to hash it would block.
+						for o < stat.Size() || (o == 0 && stat.Mode().IsRegular()) {
 							size := min(1<<20, stat.Size()-o)
 							// Get UID/GID
 							uid := stat.Sys().(*syscall.Stat_t).Uid
 							gid := stat.Sys().(*syscall.Stat_t).Gid
-							c := Chunk{Path: full_path, FileSize: stat.Size(), FileModTime: stat.ModTime(), FilePerm: stat.Mode(), Offset: o, Md5sum: "empty", data: make([]byte, size), Uid: uid, Gid: gid}
+							// data is left for hashFiles to allocate and fill.
+							c := Chunk{Path: full_path, FileSize: stat.Size(), FileModTime: stat.ModTime(), FilePerm: stat.Mode(), Offset: o, Md5sum: "empty", Uid: uid, Gid: gid}
 							out <- c
-							progress_chan <- Progress{"scanned", (uint64)(size)}
+							if progress_chan != nil { // nil when only comparing
+								progress_chan <- Progress{"scanned", (uint64)(size)}
+							}
 							o += (1 << 20)
 						}
 					}
@@ -140,24 +145,31 @@ func hashFiles(chunks chan Chunk) chan Chunk {
 	go func() {
 		for c := range chunks {
 			if (c.FilePerm & os.ModeSymlink) != 0 {
-				target, err := os.Readlink(c.Path)
-				if err != nil {
-					log.Fatal("Failed to read link: ", c.Path)
+				if c.LinkTarget == "" {
+					target, err := os.Readlink(c.Path)
+					if err != nil {
+						log.Fatal("Failed to read link: ", c.Path)
+					}
+					c.LinkTarget = target
 				}
 				csum := md5.Sum([]byte(c.Path))
 				c.Md5sum = hex.EncodeToString(csum[:])
-				c.LinkTarget = target
+			} else if c.filled {
+				csum := md5.Sum(c.data[:])
+				c.Md5sum = hex.EncodeToString(csum[:])
+				progress_chan <- Progress{"hashed", (uint64)(len(c.data))}
 			} else {
 				f, err := os.Open(c.Path)
 				if err != nil {
 					log.Printf("Couldn't open %s. Skipping it.", c.Path)
 					continue
 				}
+				c.data = make([]byte, chunkSize(c))
 				n, err := f.ReadAt(c.data, c.Offset)
 				if err != nil {
 					log.Fatal("Non EOF error on ", f.Name())
 				} else if n != len(c.data) {
-					log.Fatal("Short read: %d v %d (on %s)\n", n, len(c.data), c.Path)
+					log.Fatalf("Short read: %d v %d (on %s)\n", n, len(c.data), c.Path)
 				}
 				csum := md5.Sum(c.data[:])
 				c.Md5sum = hex.EncodeToString(csum[:])
@@ -180,7 +192,10 @@ func writeJSON(chunks chan Chunk, writer *storage.Writer) {
 		}
 
 	}
-	writer.Close()
+	err := writer.Close()
+	if err != nil {
+		log.Fatal("Failed to write manifest: ", err)
+	}
 }
 
 func uploadChunks(chunks chan Chunk, bucket string) chan Chunk {
@@ -249,360 +264,44 @@ func filterChunks(chunks chan Chunk, existing map[string]bool) (chan Chunk, chan
 	return out_new, out_existing
 }
 
-func RestoreOneChunk(f *os.File, c Chunk) {
-	n, err := f.WriteAt(c.data, c.Offset)
-	if err != nil || n != len(c.data) {
-		log.Fatal("error writing to ", f.Name(), " ", err)
-	}
-}
-
-func FixPermAndTimes(path string, chown bool, c Chunk) {
-	err := os.Chmod(path, c.FilePerm)
-	if err != nil {
-		log.Fatal("Error chmod'ing: ", err)
-	}
-	if chown {
-		err = os.Chown(path, (int)(c.Uid), (int)(c.Gid))
-		if err != nil {
-			log.Fatal("Error changing owner to ", c.Uid, " ", c.Gid, ": ", err)
-		}
-	}
-	err = os.Chtimes(path, c.FileModTime, c.FileModTime)
-	if err != nil {
-		log.Fatal("Error changing access times: ", err)
-	}
-}
-
-func RestoreFile(bucket string, chown bool, chunks []Chunk) {
-	p := chunks[0].Path
-	size := chunks[0].FileSize
-
-	// Verify chunks and fill:
-	m := make(map[int64]bool)
-	var bytes int64
-	bytes = 0
-	for i, c := range chunks {
-		if c.Path != p {
-			log.Fatal("Chunk from file ", c.Path, " while restoring ", p)
-		}
-		if c.FileSize != size {
-			log.Fatal("Mismatched sizes: ", c.FileSize, " vs ", size)
-		}
-		if m[c.Offset] {
-			log.Fatal("Duplicate offset ", c.Offset)
-		}
-		m[c.Offset] = true
-
-		chunks[i].data = readObject(bucket, c.Md5sum)
-		bytes += int64(len(chunks[i].data))
-	}
-	if bytes != size {
-		log.Fatal("Missing chunks: ", bytes, " vs ", size)
-	}
-
-	// make relative. TODO(fdabek): choose restore dir?
-	p = p[1:]
-	err := os.MkdirAll(path.Dir(p), 0777)
-	if err != nil {
-		log.Fatal("Can't create dir ", path.Dir(p), ": ", err)
-	}
-
-	if chunks[0].LinkTarget != "" {
-		err := os.Symlink(chunks[0].LinkTarget, p)
-		if err != nil {
-			log.Fatal("Error symlinking: ", p, " --> ", chunks[0].LinkTarget, ": ", err)
-		}
-	} else {
-		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0777) // we'll fix up the perms later.
-
-		if err != nil {
-			log.Fatal("Error opening: ", err)
-		}
-
-		for _, c := range chunks {
-			RestoreOneChunk(f, c)
-		}
-		f.Close()
-
-		// Fix permissions _after_ writing everything out
-		// in case any files lack write permission (this causes
-		// multi-chunk files to error when we try to write the
-		// second chunk)
-		FixPermAndTimes(p, chown, chunks[0])
-	}
-}
-
-func RestoreAll(bucket string, metadata string) {
-	chunks := make(chan Chunk)
-	var wg sync.WaitGroup
-
-	wg.Add(50)
-	for i := 0; i < 50; i++ {
-		go func() {
-			for c := range chunks {
-				// TODO(fdabek): group by files and call RestoreFile?
-				log.Fatal("Not implemented", c.Path)
-			}
-			wg.Done()
-
-		}()
-	}
-
-	r := GetReader(bucket, metadata)
-	dec := json.NewDecoder(r)
-	for dec.More() {
-		var c Chunk
-		err := dec.Decode(&c)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// make relative
-		c.Path = c.Path[1:]
-		chunks <- c
-	}
-	close(chunks)
-
-	wg.Wait()
-}
-
-type FsState struct {
-	pwd  *FsEntry
-	term *terminal.Terminal
-}
-
-type Command struct {
-	name     string
-	min_args int
-	max_args int
-	usage    string
-	cmd      func(pwd *FsState, args []string)
-}
-
-func VerifyCommand(cmd *Command, args []string) bool {
-	num_args := len(args) - 1 // -1 for command name in args[0]
-	if num_args > cmd.max_args || num_args < cmd.min_args {
-		return false
-	}
-	return true
-}
-
-func DiskUsage(dir string) uint64 {
-	path, err := exec.LookPath("du")
-	if err != nil {
-		log.Fatal("Install du")
-	}
-	cmd := exec.Command(path, "-sb", dir)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err = cmd.Run()
-	if err != nil {
-		fmt.Printf("dir is %s\n", dir)
-		log.Fatal(err)
-	}
-	s := out.String()
-	parts := strings.Split(s, "\t")
-	ret, _ := strconv.ParseInt(parts[0], 10, 64)
-	return uint64(ret)
-}
-
-func LongestPrefixString(s []string) string {
-	p := 0
-	prefix := ""
-	still_looking := true
-
-	if len(s) == 0 {
-		return ""
-	}
-
-	for still_looking {
-		if len(s[0]) <= p {
-			still_looking = false
-			break
-		}
-		cand := s[0][p]
-		for i := 1; i < len(s); i++ {
-			if len(s[i]) <= p || s[i][p] != cand {
-				still_looking = false
-				break
-			}
-		}
-		if still_looking {
-			prefix = prefix + string(cand)
-			p++
-		}
-	}
-	return prefix
-}
-
 func BackupFromRoots(bucket string, roots []string) {
 	fmt.Printf("Will backup: %q\n", roots)
 
 	progress_chan = StartProgressBar();
+	host, _ := os.Hostname()
+	chunks := walkDirectory(roots) // get all chunks in source file system
+	writeManifest(bucket, host, storeChunks(bucket, chunks))
+	close(progress_chan)
+}
 
+// storeChunks runs chunks from some source through hashing, dedup and
+// upload. Every chunk that comes out is safely in the bucket. The caller
+// starts and stops the progress bar.
+func storeChunks(bucket string, chunks chan Chunk) chan Chunk {
 	existing := make(map[string]bool)
 	fmt.Printf("Listing bucket\n")
 	for s := range ListBucket(bucket) {
 		existing[s] = true // really dumb set
 	}
 
-	chunks := walkDirectory(roots)                    // get all chunks in source file system
 	n, e := filterChunks(hashFiles(chunks), existing) // hash them to find new and existing ones
 	u := uploadChunks(n, bucket)                      // upload the new ones, spit out chunks after uploaded
-	j := mergeTwo(e, u)                               // write everything to the JSON file (if a chunk gets here it's in GCS)
+	return mergeTwo(e, u)                             // write everything to the JSON file (if a chunk gets here it's in GCS)
+}
 
+// writeManifest records chunks as a new snapshot for host.
+func writeManifest(bucket string, host string, j chan Chunk) {
 	// generate a name for the backup: metadata/hostname/YY/MM/DD/HH/MM
 	t := time.Now()
-	host, _ := os.Hostname()
 	prefix := t.Format("2006-01-02@03:04")
-	metadata_filename := "/metadata/" + host + "/" + prefix + "/backup.json"
-	w := GetWriter(bucket, metadata_filename, "application/json")
-	writeJSON(j, w)
-	close(progress_chan)
-}
-
-func InteractiveRestoreTerminal(bucket string, chown bool) {
-	// Set up the terminal
-	if !terminal.IsTerminal(0) {
-		log.Fatal("stdin not a terminal")
-	}
-	oldState, err := terminal.MakeRaw(0)
-	if err != nil {
-		log.Fatal(err)
+	// That's only to the minute, on a 12 hour clock, so a second backup
+	// of host in the same minute (or 12 hours later) gets a -2, -3, ...
+	// suffix rather than replacing the first.
+	name := prefix
+	for i := 2; ObjectExists(bucket, SnapshotMetadata(host+"/"+name)); i++ {
+		name = fmt.Sprintf("%s-%d", prefix, i)
 	}
-	defer terminal.Restore(0, oldState)
-	n := terminal.NewTerminal(os.Stdin, "> ")
-
-	// Insert the metadata directories:
-	root := MakeDirEntry("", nil)
-	for s := range ListMetadata(bucket) {
-		md_path := strings.TrimSuffix(strings.TrimPrefix(s, "/metadata"), "backup.json")
-		dumb := s
-		d := InsertPath(md_path, root)
-		d.lazy_file_maker = func() { InsertFromJSON(d, bucket, dumb) }
-	}
-
-	// setup shared state. Apparently Go captures everything in lambdas so we can get at this
-	// from the autocomplete callback.
-	var fs_state *FsState
-	fs_state = &FsState{root, n}
-
-	n.AutoCompleteCallback = func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
-		if key == 3 {
-			terminal.Restore(0, oldState)
-			os.Exit(1)
-		}
-
-		// autocomplete for 'cd' and 'restore' on TAB
-		if key == 9 {
-			parts := strings.Split(line, " ")
-			if (parts[0] == "cd" || parts[0] == "restore") && len(parts) == 2 {
-				c := ListDir(fs_state.pwd)
-				matches := []string{}
-				for _, f := range c {
-					if strings.HasPrefix(f.name, parts[1]) {
-						matches = append(matches, f.name)
-					}
-				}
-
-				if len(matches) == 1 {
-					outstring := parts[0] + " " + matches[0]
-					return outstring, len(outstring), true
-				} else {
-					stripped := []string{}
-					for _, s := range matches {
-						stripped = append(stripped, strings.TrimPrefix(s, parts[1]))
-					}
-					prefix := LongestPrefixString(stripped)
-					outstring := parts[0] + " " + parts[1] + prefix
-					return outstring, len(outstring), true
-				}
-			}
-		}
-		return "", 0, false
-	}
-
-	// Set up commands:
-	cmds := make(map[string]Command)
-	cmds["ls"] = Command{"ls", 0, 0, "ls ; List current directory", func(state *FsState, args []string) {
-		c := ListDir(state.pwd)
-		line := ""
-		for _, f := range c {
-			fname := FormatFilename(f)
-			if (len(line) + len(fname) + 1) >= 80 {
-				strings.TrimRight(line, " ")
-				n.Write([]byte(line + "\r\n"))
-				line = ""
-			}
-			line = line + fname + " "
-		}
-		if len(line) > 0 {
-			n.Write([]byte(line + "\r\n"))
-		}
-	}}
-	cmds["cd"] = Command{"cd", 1, 1, "cd dir ; Change directory", func(state *FsState, args []string) {
-		new := ChangeDir(state.pwd, args[1])
-		if new == nil {
-			n.Write([]byte("Error changing to" + args[1] + "\r\n"))
-		} else {
-			state.pwd = new
-		}
-	}}
-	cmds["restore"] = Command{"restore", 1, 1, "restore target ; Restore a file or directory", func(state *FsState, args []string) {
-		f := GetFSEntry(state.pwd, args[1])
-		if f == nil {
-			state.term.Write([]byte("Failed to open " + args[1] + "\r\n"))
-			return
-		}
-
-		c := make(chan *FsEntry)
-
-		var wg sync.WaitGroup
-		wg.Add(50)
-		for i := 0; i < 50; i++ {
-			go func() {
-				for f := range c {
-					state.term.Write([]byte("Restoring: " + f.name + "...\r\n"))
-					RestoreFile(bucket, chown, f.chunks)
-				}
-				wg.Done()
-			}()
-		}
-
-		if f.file {
-			c <- f
-		} else {
-			restore_func := func(f *FsEntry, path []*FsEntry) {
-				if f.file {
-					c <- f
-				}
-			}
-			Walk(state.pwd, 1023, restore_func)
-		}
-		close(c)
-		wg.Wait()
-	}}
-
-	// Wait for commands:
-	for {
-		line, _ := n.ReadLine()
-		if line == "exit" {
-			break
-		}
-		parts := strings.Split(line, " ")
-
-		cmd, ok := cmds[parts[0]]
-		if !ok {
-			fs_state.term.Write([]byte("Unknown command " + parts[0] + "\r\n"))
-		} else {
-			if VerifyCommand(&cmd, parts) {
-				terminal.Restore(0, oldState)
-				cmd.cmd(fs_state, parts)
-				terminal.MakeRaw(0)
-			} else {
-				fs_state.term.Write([]byte(cmd.usage + "\r\n"))
-			}
-		}
-	}
-
+	w := GetNewWriter(bucket, SnapshotMetadata(host+"/"+name), "application/json")
+	writeJSON(j, w)
+	fmt.Printf("Wrote snapshot %s/%s\n", host, name)
 }
@@ -0,0 +1,169 @@
+package dumpy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Selection is the set of files marked in the shell for one extract, keyed
+// by their path in the tree (/host/date/...), so it can span directories
+// and snapshots. Directories from the manifest are kept with a trailing
+// slash so empty ones get restored too.
+type Selection struct {
+	entries map[string]*FsEntry
+}
+
+func NewSelection() *Selection {
+	return &Selection{make(map[string]*FsEntry)}
+}
+
+// Mark adds e, which is at p, or everything under it if it's a directory.
+// Returns how many files were newly marked.
+func (s *Selection) Mark(p string, e *FsEntry) int {
+	if e.file {
+		if s.entries[p] != nil {
+			return 0
+		}
+		s.entries[p] = e
+		return 1
+	}
+	added := 0
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	if len(e.chunks) > 0 {
+		s.entries[prefix] = e
+	}
+	Walk(e, 1<<30, func(kid *FsEntry, parents []*FsEntry) {
+		kp := prefix
+		for _, d := range parents {
+			kp += d.name + "/"
+		}
+		kp += kid.name
+		if !kid.file {
+			if len(kid.chunks) > 0 {
+				s.entries[kp+"/"] = kid
+			}
+			return
+		}
+		if s.entries[kp] == nil {
+			s.entries[kp] = kid
+			added++
+		}
+	})
+	return added
+}
+
+// Unmark drops p and anything under it. Returns how many files it dropped.
+func (s *Selection) Unmark(p string) int {
+	dropped := 0
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for k, e := range s.entries {
+		if k == p || strings.HasPrefix(k, prefix) {
+			if e.file {
+				dropped++
+			}
+			delete(s.entries, k)
+		}
+	}
+	return dropped
+}
+
+func (s *Selection) Clear() {
+	s.entries = make(map[string]*FsEntry)
+}
+
+// Paths lists the marked files, sorted.
+func (s *Selection) Paths() []string {
+	ret := []string{}
+	for k, e := range s.entries {
+		if e.file {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *Selection) Size(p string) int64 {
+	return EntryInfo(s.entries[p]).Size()
+}
+
+// snapshotOf gives the host/date part of a path in the tree.
+func snapshotOf(p string) string {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 2 {
+		return p
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// Snapshots lists the snapshots the selection draws from.
+func (s *Selection) Snapshots() []string {
+	seen := make(map[string]bool)
+	ret := []string{}
+	for k := range s.entries {
+		snap := snapshotOf(k)
+		if !seen[snap] {
+			seen[snap] = true
+			ret = append(ret, snap)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Totals gives the number of files, their total size and the bytes that
+// would actually be downloaded once chunks shared between them are
+// fetched only once.
+func (s *Selection) Totals() (files int, logical int64, unique int64) {
+	seen := make(map[string]bool)
+	for _, e := range s.entries {
+		if !e.file {
+			continue
+		}
+		files++
+		logical += EntryInfo(e).Size()
+		if e.chunks[0].LinkTarget != "" {
+			continue
+		}
+		for _, c := range e.chunks {
+			if !seen[c.Md5sum] {
+				seen[c.Md5sum] = true
+				unique += chunkSize(c)
+			}
+		}
+	}
+	return
+}
+
+// Files gives the chunks to hand to RestoreFiles. When the selection
+// spans more than one snapshot the same path could turn up several times,
+// so each file's path gets its host/date in front.
+func (s *Selection) Files() [][]Chunk {
+	prefix := len(s.Snapshots()) > 1
+	files := make([][]Chunk, 0, len(s.entries))
+	for k, e := range s.entries {
+		if !prefix {
+			files = append(files, e.chunks)
+			continue
+		}
+		chunks := make([]Chunk, len(e.chunks))
+		for i, c := range e.chunks {
+			c.Path = "/" + snapshotOf(k) + c.Path
+			chunks[i] = c
+		}
+		files = append(files, chunks)
+	}
+	return files
+}
+
+// Check says whether the selection can be extracted with opts.
+func (s *Selection) Check(opts *RestoreOptions) error {
+	if len(s.Paths()) == 0 {
+		return fmt.Errorf("nothing is marked")
+	}
+	if opts.InPlace && len(s.Snapshots()) > 1 {
+		return fmt.Errorf("the selection spans %d snapshots; extract it with -target instead of -inplace", len(s.Snapshots()))
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package dumpy
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var browseTemplate = template.Must(template.New("browse").Funcs(template.FuncMap{
+	"bytes": func(n int64) string { return humanize.Bytes(uint64(n)) },
+	"link":  browseLink,
+}).Parse(`<!DOCTYPE html>
+<html><head><title>dumpy: /{{.Path}}</title>
+<style>body{font-family:sans-serif} td{padding:0 1em 0 0} .r{text-align:right}</style>
+</head><body>
+<h2>{{range .Crumbs}}<a href="{{link "browse" .Path}}">{{.Name}}</a>/{{end}}</h2>
+{{if .Path}}<p>Download as <a href="{{link "browse" .Path}}?format=tar">tar</a> or
+<a href="{{link "browse" .Path}}?format=zip">zip</a></p>{{end}}
+<table>
+{{range .Entries}}<tr>
+<td>{{.Mode}}</td>
+<td><a href="{{link "browse" .Path}}">{{.Name}}</a>{{if .Target}} -&gt; {{.Target}}{{end}}</td>
+<td class="r">{{if .File}}{{bytes .Size}}{{end}}</td>
+<td>{{if .File}}{{.ModTime.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if .History}}<a href="{{link "history" .Path}}">history</a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body></html>
+`))
+
+var historyTemplate = template.Must(template.New("history").Funcs(template.FuncMap{
+	"bytes": func(n int64) string { return humanize.Bytes(uint64(n)) },
+	"link":  browseLink,
+}).Parse(`<!DOCTYPE html>
+<html><head><title>dumpy: history of {{.Path}}</title>
+<style>body{font-family:sans-serif} td{padding:0 1em 0 0; vertical-align:top}</style>
+</head><body>
+<h2>History of {{.Path}} on {{.Host}}</h2>
+<table>
+<tr><th>Size</th><th>Modified</th><th>Content</th><th>Snapshots</th></tr>
+{{range .Versions}}<tr>
+<td>{{bytes .Size}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
+<td><code>{{.ContentId}}</code></td>
+<td>{{range .Snapshots}}<a href="{{link "browse" (printf "%s%s" . $.Path)}}">{{.}}</a><br>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="4">Not found in any snapshot.</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// browseLink builds an absolute URL for a path in the tree. Snapshot names
+// have colons in them, so every segment gets escaped.
+func browseLink(handler string, p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/" + handler + "/" + strings.Join(parts, "/")
+}
+
+type crumb struct {
+	Name string
+	Path string
+}
+
+type listing struct {
+	Name    string
+	Path    string
+	File    bool
+	Mode    string
+	Size    int64
+	ModTime time.Time
+	Target  string
+	History bool
+}
+
+type server struct {
+	bucket string
+	fsys   *SnapshotFS
+}
+
+// Serve runs a read-only web UI for browsing every snapshot in the bucket
+// at addr, which should normally be on localhost.
+func Serve(bucket string, addr string) error {
+	s := &server{bucket, NewBucketFS(bucket)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/browse/", http.StatusFound)
+	})
+	mux.HandleFunc("/browse/", s.browse)
+	mux.HandleFunc("/history/", s.history)
+	log.Printf("Serving %s on http://%s/\n", bucket, addr)
+	return http.ListenAndServe(addr, readOnly(mux))
+}
+
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "read only", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// treePath turns a request path into a path in the tree ("." for the root).
+func treePath(r *http.Request, handler string) string {
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/"+handler), "/")
+	if p == "" {
+		return "."
+	}
+	return path.Clean(p)
+}
+
+func (s *server) browse(w http.ResponseWriter, r *http.Request) {
+	p := treePath(r, "browse")
+	e, err := s.fsys.lookup("open", p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if e.file {
+		if e.chunks[0].LinkTarget != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, e.name+" -> "+e.chunks[0].LinkTarget+"\n")
+			return
+		}
+		f, err := s.fsys.Open(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, e.name, EntryInfo(e).ModTime(), f.(io.ReadSeeker))
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		s.download(w, e, format)
+		return
+	}
+
+	// Directories two levels down are snapshots; anything below them has
+	// a history.
+	depth := 0
+	if p != "." {
+		depth = strings.Count(p, "/") + 1
+	}
+	data := struct {
+		Path    string
+		Crumbs  []crumb
+		Entries []listing
+	}{}
+	if p != "." {
+		data.Path = p
+	}
+	data.Crumbs = append(data.Crumbs, crumb{"dumpy", ""})
+	sofar := ""
+	for _, part := range strings.Split(data.Path, "/") {
+		if part == "" {
+			continue
+		}
+		sofar = path.Join(sofar, part)
+		data.Crumbs = append(data.Crumbs, crumb{part, sofar})
+	}
+	for _, d := range s.fsys.readDir(e) {
+		info, _ := d.Info()
+		l := listing{
+			Name:    d.Name(),
+			Path:    path.Join(data.Path, d.Name()),
+			File:    !d.IsDir(),
+			Mode:    info.Mode().String(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			History: !d.IsDir() && depth >= 2,
+		}
+		if c, ok := info.Sys().(*Chunk); ok {
+			l.Target = c.LinkTarget
+		}
+		data.Entries = append(data.Entries, l)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = browseTemplate.Execute(w, data)
+	if err != nil {
+		log.Println("Error rendering ", p, ": ", err)
+	}
+}
+
+// download sends a directory as an archive.
+func (s *server) download(w http.ResponseWriter, e *FsEntry, format string) {
+	if format != "tar" && format != "zip" {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	// Read in every manifest underneath first, so the export can walk the
+	// tree without holding the lock while it streams.
+	s.fsys.mu.Lock()
+	Walk(e, 1<<30, func(*FsEntry, []*FsEntry) {})
+	s.fsys.mu.Unlock()
+
+	name := e.name
+	if name == "" {
+		name = "dumpy"
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.Replace(name, "\"", "", -1)+"."+format+"\"")
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	err := ExportArchive(s.bucket, e, format, w)
+	if err != nil {
+		// Too late for an error page; cut the archive short instead.
+		log.Println("Error exporting ", e.name, ": ", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *server) history(w http.ResponseWriter, r *http.Request) {
+	// host/date/some/file
+	parts := strings.SplitN(treePath(r, "history"), "/", 3)
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Host     string
+		Path     string
+		Versions []FileVersion
+	}{Host: parts[0], Path: "/" + parts[2]}
+
+	data.Versions = FileVersions(s.bucket, data.Host, data.Path)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := historyTemplate.Execute(w, data)
+	if err != nil {
+		log.Println("Error rendering history of ", data.Path, ": ", err)
+	}
+}
@@ -0,0 +1,678 @@
+package dumpy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+	terminal "golang.org/x/crypto/ssh/terminal"
+)
+
+type FsState struct {
+	root   *FsEntry
+	pwd    *FsEntry
+	term   *terminal.Terminal
+	marked *Selection // for extract
+}
+
+type Command struct {
+	name     string
+	min_args int
+	max_args int // -1 for no limit
+	usage    string
+	cmd      func(pwd *FsState, args []string)
+}
+
+func VerifyCommand(cmd *Command, args []string) bool {
+	num_args := len(args) - 1 // -1 for command name in args[0]
+	if (cmd.max_args >= 0 && num_args > cmd.max_args) || num_args < cmd.min_args {
+		return false
+	}
+	return true
+}
+
+func LongestPrefixString(s []string) string {
+	p := 0
+	prefix := ""
+	still_looking := true
+
+	if len(s) == 0 {
+		return ""
+	}
+
+	for still_looking {
+		if len(s[0]) <= p {
+			still_looking = false
+			break
+		}
+		cand := s[0][p]
+		for i := 1; i < len(s); i++ {
+			if len(s[i]) <= p || s[i][p] != cand {
+				still_looking = false
+				break
+			}
+		}
+		if still_looking {
+			prefix = prefix + string(cand)
+			p++
+		}
+	}
+	return prefix
+}
+
+// splitTreePath turns name into a host and a path inside that host's
+// snapshots. The file itself needn't be in the snapshot name is looked up
+// in (it may have been deleted since), only the directory it's in. The
+// path is "" if name isn't inside a snapshot.
+func splitTreePath(state *FsState, name string) (string, string) {
+	p := CanonicalPath(state.root, state.pwd, name)
+	if p == "" {
+		dir, base := ".", strings.TrimRight(name, "/")
+		if i := strings.LastIndex(base, "/"); i >= 0 {
+			dir, base = base[:i+1], base[i+1:]
+		}
+		if d := CanonicalPath(state.root, state.pwd, dir); d != "" && base != "" {
+			p = strings.TrimSuffix(d, "/") + "/" + base
+		}
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 3 || parts[2] == "" {
+		return "", ""
+	}
+	return parts[0], "/" + parts[2]
+}
+
+// splitSnapshotPath splits name into a snapshot id and a directory in it
+// by its path alone. Commands that work from the index use it, since
+// reading the snapshot into the tree as well would download its manifest
+// twice. The id is "" if name isn't in a snapshot.
+func splitSnapshotPath(state *FsState, name string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(LexicalPath(state.pwd, name), "/"), "/", 3)
+	if len(parts) < 2 {
+		return "", ""
+	}
+	if e := LookupPath(state.root, parts[0]+"/"+parts[1]); e == nil || !e.snapshot {
+		return "", ""
+	}
+	prefix := "/"
+	if len(parts) == 3 {
+		prefix += parts[2]
+	}
+	return parts[0] + "/" + parts[1], prefix
+}
+
+// parseRestoreFlags parses a shell command's restore flags over the
+// defaults from the command line. Where to restore is whatever was typed
+// last: -target in the shell drops an -inplace from the command line and
+// -inplace drops a -target (and a -strip), instead of them conflicting.
+func parseRestoreFlags(flags *flag.FlagSet, opts *RestoreOptions, args []string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["inplace"] && !set["target"] {
+		opts.Target = ""
+	}
+	if set["inplace"] && !set["strip"] {
+		opts.Strip = ""
+	}
+	if set["target"] && !set["inplace"] {
+		opts.InPlace = false
+	}
+	return nil
+}
+
+// statEntry prints stat output for one path.
+func statEntry(state *FsState, name string) {
+	f := GetFSEntry(state.root, state.pwd, name)
+	if f == nil {
+		state.term.Write([]byte("No such file or directory: " + name + "\r\n"))
+		return
+	}
+	p := CanonicalPath(state.root, state.pwd, name)
+	uses := map[string]int{}
+	if snap := SnapshotRoot(LookupPath(state.root, path.Dir(p))); f.file && snap != nil {
+		uses = ChunkUses(snap)
+	}
+	WriteStat(state.term, p, f, uses)
+}
+
+func InteractiveRestoreTerminal(bucket string, defaults RestoreOptions) {
+	// Set up the terminal
+	if !terminal.IsTerminal(0) {
+		log.Fatal("stdin not a terminal")
+	}
+	oldState, err := terminal.MakeRaw(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer terminal.Restore(0, oldState)
+	n := terminal.NewTerminal(os.Stdin, "> ")
+
+	// Insert the metadata directories:
+	root := MetadataTree(bucket)
+
+	// setup shared state. Apparently Go captures everything in lambdas so we can get at this
+	// from the autocomplete callback.
+	var fs_state *FsState
+	fs_state = &FsState{root, root, n, NewSelection()}
+
+	// commands whose last argument is a path
+	completes := map[string]bool{"cd": true, "ls": true, "restore": true, "cat": true, "export": true, "stat": true, "mark": true, "unmark": true, "versions": true, "diff": true, "du": true}
+
+	n.AutoCompleteCallback = func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+		if key == 3 {
+			terminal.Restore(0, oldState)
+			os.Exit(1)
+		}
+
+		// autocomplete paths on TAB
+		if key == 9 {
+			words, err := splitLine(line)
+			if err == nil && len(words) >= 2 && completes[words[0].text] && !strings.HasSuffix(line, " ") {
+				last := words[len(words)-1]
+				completed := CompletePath(fs_state.root, fs_state.pwd, last.text)
+				if completed != last.text {
+					outstring := line[:last.start] + QuoteWord(completed)
+					return outstring, len(outstring), true
+				}
+			}
+		}
+		return "", 0, false
+	}
+
+	// Set up commands:
+	cmds := make(map[string]Command)
+	cmds["ls"] = Command{"ls", 0, -1, "ls [-lhStr] [path ...] ; List directories (default: current)", func(state *FsState, args []string) {
+		var lopts ListOptions
+		flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		lopts.AddFlags(flags)
+		if flags.Parse(SplitShortFlags(flags, args[1:])) != nil {
+			state.term.Write([]byte("usage: ls [-lhStr] [path ...]\r\n"))
+			return
+		}
+		list := func(c []*FsEntry) {
+			SortEntries(c, lopts)
+			if lopts.Long {
+				WriteLong(state.term, c, lopts.Human)
+			} else {
+				WriteShort(state.term, c)
+			}
+		}
+		if flags.NArg() == 0 {
+			list(ListDir(state.pwd))
+			return
+		}
+
+		// Like ls, files named on the command line come first, then the
+		// contents of each directory.
+		files := []*FsEntry{}
+		dirs := []string{}
+		for _, name := range flags.Args() {
+			f := GetFSEntry(state.root, state.pwd, name)
+			if f == nil {
+				state.term.Write([]byte("No such file or directory: " + name + "\r\n"))
+			} else if f.file {
+				files = append(files, f)
+			} else {
+				dirs = append(dirs, name)
+			}
+		}
+		if len(files) > 0 {
+			list(files)
+		}
+		for i, name := range dirs {
+			if flags.NArg() > 1 {
+				if i > 0 || len(files) > 0 {
+					state.term.Write([]byte("\r\n"))
+				}
+				state.term.Write([]byte(name + ":\r\n"))
+			}
+			list(ListDir(GetFSEntry(state.root, state.pwd, name)))
+		}
+	}}
+	cmds["stat"] = Command{"stat", 1, -1, "stat path ... ; Show a file's metadata, chunks and dedup status", func(state *FsState, args []string) {
+		for _, name := range args[1:] {
+			statEntry(state, name)
+		}
+	}}
+	cmds["cd"] = Command{"cd", 1, 1, "cd dir ; Change directory (/host/date/..., ~ for the snapshot root, ..)", func(state *FsState, args []string) {
+		new := ChangeDir(state.root, state.pwd, args[1])
+		if new == nil {
+			n.Write([]byte("Error changing to " + args[1] + "\r\n"))
+		} else {
+			state.pwd = new
+			n.SetPrompt(EntryPath(new) + "> ")
+		}
+	}}
+	cmds["restore"] = Command{"restore", 1, -1, "restore [flags] target ... ; Restore files or whole directory trees (-n: dry run; restore -h lists flags)", func(state *FsState, args []string) {
+		opts := defaults
+		opts.Verbose = true
+		flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		opts.AddFlags(flags)
+		opts.AddRunFlags(flags)
+		if parseRestoreFlags(flags, &opts, args[1:]) != nil || flags.NArg() == 0 {
+			state.term.Write([]byte("usage: restore [flags] target ...\r\n"))
+			return
+		}
+		if err := opts.Check(); err != nil {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+
+		// A directory restores everything under it, at any depth, to the
+		// paths recorded in its snapshot's manifest.
+		seen := make(map[string]bool)
+		files := [][]Chunk{}
+		for _, name := range flags.Args() {
+			f := GetFSEntry(state.root, state.pwd, name)
+			if f == nil {
+				state.term.Write([]byte("Failed to open " + name + "\r\n"))
+				return
+			}
+			if !f.file && SnapshotRoot(f) == nil {
+				state.term.Write([]byte(name + " is not inside a snapshot; cd into one, or use mark and extract\r\n"))
+				return
+			}
+			for _, chunks := range SubtreeFiles(f) {
+				if !seen[chunks[0].Path] {
+					seen[chunks[0].Path] = true
+					files = append(files, chunks)
+				}
+			}
+		}
+		if opts.DryRun {
+			DryRunRestore(state.term, &opts, files)
+			return
+		}
+		todo, dirs := planRestore(files)
+		state.term.Write([]byte(fmt.Sprintf("Restoring %d files in %d directories\r\n", len(todo), len(dirs))))
+		RestoreFiles(bucket, &opts, files).Print(state.term)
+	}}
+
+	cmds["export"] = Command{"export", 2, 4, "export [-format tar|zip] target file ; Write a file or directory to an archive", func(state *FsState, args []string) {
+		flags := flag.NewFlagSet("export", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		format := flags.String("format", "tar", "Archive format: tar|zip")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 2 {
+			state.term.Write([]byte("usage: export [-format tar|zip] target file\r\n"))
+			return
+		}
+		f := GetFSEntry(state.root, state.pwd, flags.Arg(0))
+		if f == nil {
+			state.term.Write([]byte("Failed to open " + flags.Arg(0) + "\r\n"))
+			return
+		}
+		out, err := os.Create(flags.Arg(1))
+		if err != nil {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+		err = ExportArchive(bucket, f, *format, out)
+		if err == nil {
+			err = out.Close()
+		} else {
+			out.Close()
+		}
+		if err != nil {
+			state.term.Write([]byte("Export failed: " + err.Error() + "\r\n"))
+		}
+	}}
+
+	cmds["cat"] = Command{"cat", 1, -1, "cat [-p] file ... ; Print files (-p: through $PAGER)", func(state *FsState, args []string) {
+		flags := flag.NewFlagSet("cat", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		pager := flags.Bool("p", false, "Page the output")
+		if flags.Parse(args[1:]) != nil || flags.NArg() == 0 {
+			state.term.Write([]byte("usage: cat [-p] file ...\r\n"))
+			return
+		}
+		entries := []*FsEntry{}
+		for _, name := range flags.Args() {
+			f := GetFSEntry(state.root, state.pwd, name)
+			if f == nil {
+				state.term.Write([]byte("Failed to open " + name + "\r\n"))
+				return
+			}
+			entries = append(entries, f)
+		}
+
+		// The terminal is out of raw mode while commands run, so output
+		// can go straight to stdout (or the pager).
+		var out io.Writer = os.Stdout
+		var cmd *exec.Cmd
+		var pipe io.WriteCloser
+		if *pager {
+			p := os.Getenv("PAGER")
+			if p == "" {
+				p = "less"
+			}
+			cmd = exec.Command("/bin/sh", "-c", p)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			var err error
+			pipe, err = cmd.StdinPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			if err != nil {
+				state.term.Write([]byte("Can't run " + p + ": " + err.Error() + "\r\n"))
+				return
+			}
+			out = pipe
+		}
+		var err error
+		for _, f := range entries {
+			err = CatFile(bucket, f, out)
+			if err != nil {
+				break
+			}
+		}
+		if cmd != nil {
+			pipe.Close()
+			cmd.Wait()
+		}
+		// A pager that quits early closes the pipe; that's not worth
+		// complaining about.
+		if err != nil && !errors.Is(err, syscall.EPIPE) {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+		}
+	}}
+
+	cmds["mark"] = Command{"mark", 1, -1, "mark path ... ; Add files or directories to the selection for extract", func(state *FsState, args []string) {
+		for _, name := range args[1:] {
+			f := GetFSEntry(state.root, state.pwd, name)
+			if f == nil {
+				state.term.Write([]byte("No such file or directory: " + name + "\r\n"))
+				continue
+			}
+			added := state.marked.Mark(CanonicalPath(state.root, state.pwd, name), f)
+			state.term.Write([]byte(fmt.Sprintf("%s: %d files marked\r\n", name, added)))
+		}
+		files, logical, _ := state.marked.Totals()
+		state.term.Write([]byte(fmt.Sprintf("%d files, %s selected\r\n", files, humanize.Bytes(uint64(logical)))))
+	}}
+
+	cmds["unmark"] = Command{"unmark", 1, -1, "unmark -a | path ... ; Remove files or directories (-a: everything) from the selection", func(state *FsState, args []string) {
+		if len(args) == 2 && args[1] == "-a" {
+			state.marked.Clear()
+			return
+		}
+		for _, name := range args[1:] {
+			// What was marked may no longer resolve (say, from another
+			// snapshot), so fall back to the path as given.
+			p := CanonicalPath(state.root, state.pwd, name)
+			if p == "" {
+				p = name
+			}
+			dropped := state.marked.Unmark(p)
+			state.term.Write([]byte(fmt.Sprintf("%s: %d files unmarked\r\n", name, dropped)))
+		}
+	}}
+
+	cmds["marked"] = Command{"marked", 0, 0, "marked ; List the selection and its size", func(state *FsState, args []string) {
+		for _, p := range state.marked.Paths() {
+			state.term.Write([]byte(fmt.Sprintf("%10s  %s\r\n", humanize.Bytes(uint64(state.marked.Size(p))), p)))
+		}
+		files, logical, unique := state.marked.Totals()
+		state.term.Write([]byte(fmt.Sprintf("%d files from %d snapshots, %s (%s to download)\r\n",
+			files, len(state.marked.Snapshots()), humanize.Bytes(uint64(logical)), humanize.Bytes(uint64(unique)))))
+	}}
+
+	cmds["extract"] = Command{"extract", 0, -1, "extract [flags] ; Restore the selection in one job (extract -h lists flags)", func(state *FsState, args []string) {
+		opts := defaults
+		flags := flag.NewFlagSet("extract", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		opts.AddFlags(flags)
+		opts.AddRunFlags(flags)
+		if parseRestoreFlags(flags, &opts, args[1:]) != nil || flags.NArg() != 0 {
+			state.term.Write([]byte("usage: extract [flags]\r\n"))
+			return
+		}
+		err := opts.Check()
+		if err == nil {
+			err = state.marked.Check(&opts)
+		}
+		if err != nil {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+		if opts.DryRun {
+			DryRunRestore(state.term, &opts, state.marked.Files())
+			return
+		}
+		report := RestoreFiles(bucket, &opts, state.marked.Files())
+		report.Print(state.term)
+		if report.Ok() {
+			state.marked.Clear()
+		}
+	}}
+
+	cmds["find"] = Command{"find", 1, -1, "find [-host h] [-after date] [-before date] pattern ; Search every snapshot for names (or paths, with a /)", func(state *FsState, args []string) {
+		var filter SnapshotFilter
+		flags := flag.NewFlagSet("find", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		flags.StringVar(&filter.Host, "host", "", "Only this host's snapshots")
+		filter.AddFlags(flags)
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 1 {
+			state.term.Write([]byte("usage: find [-host h] [-after date] [-before date] pattern\r\n"))
+			return
+		}
+		results, err := FindFiles(bucket, filter, flags.Arg(0))
+		if err != nil {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+		PrintFindResults(state.term, results)
+		state.term.Write([]byte(fmt.Sprintf("%d found\r\n", len(results))))
+	}}
+
+	cmds["versions"] = Command{"versions", 1, -1, "versions [-cat n | -restore n [flags]] path ; List every version of a file, or cat or restore one", func(state *FsState, args []string) {
+		opts := defaults
+		flags := flag.NewFlagSet("versions", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		cat := flags.Int("cat", 0, "Print version n")
+		restore := flags.Int("restore", 0, "Restore version n")
+		opts.AddFlags(flags)
+		opts.AddRunFlags(flags)
+		if parseRestoreFlags(flags, &opts, args[1:]) != nil || flags.NArg() != 1 {
+			state.term.Write([]byte("usage: versions [-cat n | -restore n [flags]] path\r\n"))
+			return
+		}
+		host, p := splitTreePath(state, flags.Arg(0))
+		if p == "" {
+			state.term.Write([]byte(flags.Arg(0) + " is not a path inside a snapshot\r\n"))
+			return
+		}
+		versions := FileVersions(bucket, host, p)
+		if len(versions) == 0 {
+			state.term.Write([]byte(p + " is in no snapshot of " + host + "\r\n"))
+			return
+		}
+		if *cat == 0 && *restore == 0 {
+			PrintVersions(state.term, versions)
+			return
+		}
+
+		n := *cat
+		if n == 0 {
+			n = *restore
+		}
+		if n < 1 || n > len(versions) {
+			state.term.Write([]byte(fmt.Sprintf("No version %d; there are %d\r\n", n, len(versions))))
+			return
+		}
+		snap := versions[n-1].Newest()
+		f := LookupPath(state.root, snap+p)
+		if f == nil || !f.file {
+			state.term.Write([]byte("Can't find " + p + " in " + snap + "\r\n"))
+			return
+		}
+		if *cat != 0 {
+			err := CatFile(bucket, f, os.Stdout)
+			if err != nil {
+				state.term.Write([]byte(err.Error() + "\r\n"))
+			}
+			return
+		}
+		if err := opts.Check(); err != nil {
+			state.term.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+		if opts.DryRun {
+			DryRunRestore(state.term, &opts, [][]Chunk{f.chunks})
+			return
+		}
+		state.term.Write([]byte("Restoring " + p + " from " + snap + "\r\n"))
+		RestoreFiles(bucket, &opts, [][]Chunk{f.chunks}).Print(state.term)
+	}}
+
+	cmds["diff"] = Command{"diff", 2, 3, "diff [-json] from to ; Show what changed between two snapshots (or the same directory in each)", func(state *FsState, args []string) {
+		flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		as_json := flags.Bool("json", false, "Print JSON")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 2 {
+			state.term.Write([]byte("usage: diff [-json] from to\r\n"))
+			return
+		}
+		sides := [2][]IndexEntry{}
+		snaps := [2]string{}
+		for i, name := range flags.Args() {
+			snap, prefix := splitSnapshotPath(state, name)
+			if snap != "" {
+				sides[i] = SubIndex(LoadIndex(bucket, snap), prefix)
+			}
+			// A directory has at least its own entry, or those of
+			// the things in it.
+			if snap == "" || len(sides[i]) == 0 {
+				state.term.Write([]byte(name + " is not a snapshot or a directory in one\r\n"))
+				return
+			}
+			snaps[i] = snap
+		}
+		d := &Diff{From: snaps[0], To: snaps[1], Changes: DiffIndexes(sides[0], sides[1])}
+		if *as_json {
+			d.PrintJSON(state.term)
+		} else {
+			d.PrintText(state.term)
+		}
+	}}
+
+	cmds["compare"] = Command{"compare", 1, 4, "compare [-hash] [-json] localdir [dir] ; Compare a directory on this machine with one in a snapshot (default: the current one)", func(state *FsState, args []string) {
+		flags := flag.NewFlagSet("compare", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		hash := flags.Bool("hash", false, "Read and hash local files to compare contents, not just sizes")
+		as_json := flags.Bool("json", false, "Print JSON")
+		if flags.Parse(args[1:]) != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+			state.term.Write([]byte("usage: compare [-hash] [-json] localdir [dir]\r\n"))
+			return
+		}
+		name := "."
+		if flags.NArg() == 2 {
+			name = flags.Arg(1)
+		}
+		snap, prefix := splitSnapshotPath(state, name)
+		if snap == "" || len(SubIndex(LoadIndex(bucket, snap), prefix)) == 0 {
+			state.term.Write([]byte(name + " is not a snapshot or a directory in one\r\n"))
+			return
+		}
+		d := CompareLocal(bucket, snap, prefix, flags.Arg(0), *hash)
+		if *as_json {
+			d.PrintJSON(state.term)
+		} else {
+			d.PrintText(state.term)
+		}
+	}}
+
+	cmds["du"] = Command{"du", 0, -1, "du [-s] [-h] [path ...] ; Show files, size and unique (deduplicated) bytes under each subdirectory and in total", func(state *FsState, args []string) {
+		flags := flag.NewFlagSet("du", flag.ContinueOnError)
+		flags.SetOutput(state.term)
+		summary := flags.Bool("s", false, "Only the total for each path")
+		human := flags.Bool("h", false, "Human readable sizes")
+		if flags.Parse(SplitShortFlags(flags, args[1:])) != nil {
+			state.term.Write([]byte("usage: du [-s] [-h] [path ...]\r\n"))
+			return
+		}
+		names := flags.Args()
+		if len(names) == 0 {
+			names = []string{"."}
+		}
+		for _, name := range names {
+			f := GetFSEntry(state.root, state.pwd, name)
+			if f == nil {
+				state.term.Write([]byte("No such file or directory: " + name + "\r\n"))
+				continue
+			}
+			if !f.file && SnapshotRoot(f) == nil {
+				// Adding it up would download every manifest under it.
+				state.term.Write([]byte(name + " is not inside a snapshot; cd into one first\r\n"))
+				continue
+			}
+			if *summary || f.file {
+				WriteUsage(state.term, TreeUsage(f), name, *human)
+				continue
+			}
+			total, kids := ChildUsage(f)
+			for _, kid := range ListDir(f) {
+				if !kid.file {
+					WriteUsage(state.term, kids[kid.name], strings.TrimSuffix(name, "/")+"/"+kid.name, *human)
+				}
+			}
+			WriteUsage(state.term, total, name, *human)
+		}
+	}}
+
+	// Commands that take patterns of their own rather than paths, or
+	// paths on this machine.
+	noglob := map[string]bool{"find": true, "compare": true}
+
+	// Wait for commands:
+	for {
+		line, _ := n.ReadLine()
+		if line == "exit" {
+			break
+		}
+		words, err := splitLine(line)
+		if err != nil {
+			fs_state.term.Write([]byte(err.Error() + "\r\n"))
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		parts := []string{}
+		if noglob[words[0].text] {
+			for _, w := range words {
+				parts = append(parts, w.text)
+			}
+		} else {
+			parts = ExpandWords(fs_state.root, fs_state.pwd, words)
+		}
+
+		cmd, ok := cmds[parts[0]]
+		if !ok {
+			fs_state.term.Write([]byte("Unknown command " + parts[0] + "\r\n"))
+		} else {
+			if VerifyCommand(&cmd, parts) {
+				terminal.Restore(0, oldState)
+				cmd.cmd(fs_state, parts)
+				terminal.MakeRaw(0)
+			} else {
+				fs_state.term.Write([]byte(cmd.usage + "\r\n"))
+			}
+		}
+	}
+
+}
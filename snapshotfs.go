@@ -0,0 +1,245 @@
+package dumpy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// SnapshotFS is a read-only io/fs view of a tree of FsEntry: one snapshot
+// (OpenSnapshotFS) or every snapshot in a bucket laid out as host/date/...
+// (NewBucketFS). Files fetch their chunks from the bucket only when read.
+type SnapshotFS struct {
+	bucket string
+	root   *FsEntry
+
+	// The tree reads manifests lazily as it is explored, which isn't
+	// safe to do from more than one goroutine at a time.
+	mu sync.Mutex
+}
+
+var (
+	_ fs.ReadDirFS = (*SnapshotFS)(nil)
+	_ fs.StatFS    = (*SnapshotFS)(nil)
+	_ io.ReaderAt  = (*snapshotFile)(nil)
+	_ io.Seeker    = (*snapshotFile)(nil)
+	_ io.Seeker    = (*snapshotLink)(nil)
+)
+
+func NewSnapshotFS(bucket string, root *FsEntry) *SnapshotFS {
+	return &SnapshotFS{bucket: bucket, root: root}
+}
+
+// OpenSnapshotFS reads one snapshot's manifest and serves it.
+func OpenSnapshotFS(bucket string, snapshot string) *SnapshotFS {
+	return NewSnapshotFS(bucket, LoadSnapshot(bucket, snapshot))
+}
+
+// NewBucketFS serves every snapshot in the bucket.
+func NewBucketFS(bucket string) *SnapshotFS {
+	return NewSnapshotFS(bucket, MetadataTree(bucket))
+}
+
+func (fsys *SnapshotFS) lookup(op string, name string) (*FsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	fsys.mu.Lock()
+	e := LookupPath(fsys.root, name)
+	if e != nil && !e.file {
+		loadEntry(e)
+	}
+	fsys.mu.Unlock()
+	if e == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (fsys *SnapshotFS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.file {
+		return &snapshotDir{fsys: fsys, e: e}, nil
+	}
+	if e.chunks[0].LinkTarget != "" {
+		// Targets point into the original machine's file system, so
+		// there's nothing sensible to follow them to. Show the link as
+		// a small file holding its target instead.
+		return &snapshotLink{bytes.NewReader([]byte(e.chunks[0].LinkTarget)), e}, nil
+	}
+	return &snapshotFile{fsys: fsys, e: e, chunks: sortChunks(e.chunks)}, nil
+}
+
+func (fsys *SnapshotFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return EntryInfo(e), nil
+}
+
+func (fsys *SnapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.file {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.readDir(e), nil
+}
+
+func (fsys *SnapshotFS) readDir(e *FsEntry) []fs.DirEntry {
+	fsys.mu.Lock()
+	kids := ListDir(e)
+	fsys.mu.Unlock()
+	ret := make([]fs.DirEntry, len(kids))
+	for i, kid := range kids {
+		ret[i] = fs.FileInfoToDirEntry(EntryInfo(kid))
+	}
+	return ret
+}
+
+// snapshotFile reads a file's chunks on demand. It keeps the last chunk it
+// fetched, so sequential reads download each chunk once.
+type snapshotFile struct {
+	fsys   *SnapshotFS
+	e      *FsEntry
+	chunks []Chunk // in offset order
+
+	mu     sync.Mutex
+	offset int64
+	last   Chunk // with data
+}
+
+func (f *snapshotFile) Stat() (fs.FileInfo, error) { return EntryInfo(f.e), nil }
+func (f *snapshotFile) Close() error               { return nil }
+
+func (f *snapshotFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	off := f.offset
+	f.mu.Unlock()
+	n, err := f.ReadAt(p, off)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	f.mu.Lock()
+	f.offset = off + int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.e.chunks[0].FileSize
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// chunkAt returns the chunk covering off, with its data.
+func (f *snapshotFile) chunkAt(off int64) (Chunk, error) {
+	i := sort.Search(len(f.chunks), func(i int) bool {
+		return f.chunks[i].Offset+chunkSize(f.chunks[i]) > off
+	})
+	if i == len(f.chunks) {
+		return Chunk{}, io.EOF
+	}
+	c := f.chunks[i]
+
+	f.mu.Lock()
+	last := f.last
+	f.mu.Unlock()
+	if last.data != nil && last.Offset == c.Offset {
+		return last, nil
+	}
+	data, err := fetchChunk(f.fsys.bucket, c)
+	if err != nil {
+		return Chunk{}, err
+	}
+	c.data = data
+	f.mu.Lock()
+	f.last = c
+	f.mu.Unlock()
+	return c, nil
+}
+
+// ReadAt fetches only the chunks that cover [off, off+len(p)).
+func (f *snapshotFile) ReadAt(p []byte, off int64) (int, error) {
+	size := f.e.chunks[0].FileSize
+	n := 0
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+		c, err := f.chunkAt(off)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], c.data[off-c.Offset:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// snapshotLink is an opened symlink. Its Stat says ModeSymlink and reading
+// it gives the link's target.
+type snapshotLink struct {
+	*bytes.Reader
+	e *FsEntry
+}
+
+func (l *snapshotLink) Stat() (fs.FileInfo, error) { return EntryInfo(l.e), nil }
+func (l *snapshotLink) Close() error               { return nil }
+
+type snapshotDir struct {
+	fsys *SnapshotFS
+	e    *FsEntry
+
+	entries []fs.DirEntry // nil until the first ReadDir
+	pos     int
+}
+
+func (d *snapshotDir) Stat() (fs.FileInfo, error) { return EntryInfo(d.e), nil }
+func (d *snapshotDir) Close() error               { return nil }
+
+func (d *snapshotDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.e.name, Err: errors.New("is a directory")}
+}
+
+func (d *snapshotDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		d.entries = d.fsys.readDir(d.e)
+	}
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
@@ -0,0 +1,208 @@
+package dumpy
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+// readChunks cuts r into chunks of up to 1MB, each a copy of c with Offset
+// and data filled in, and sends them to out. At least one chunk is sent, so
+// empty files still make it into the manifest. Returns the total size.
+func readChunks(r io.Reader, c Chunk, out chan Chunk) int64 {
+	var o int64
+	o = 0
+	for {
+		data := make([]byte, 1<<20)
+		n, err := io.ReadFull(r, data)
+		if n > 0 || o == 0 {
+			c.Offset = o
+			c.data = data[:n]
+			c.filled = true
+			out <- c
+			progress_chan <- Progress{"scanned", (uint64)(n)}
+			o += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return o
+		}
+		if err != nil {
+			log.Fatal("Error reading ", c.Path, ": ", err)
+		}
+	}
+}
+
+// hardLink is a tar entry that names an earlier entry's contents.
+type hardLink struct {
+	path   string
+	target string
+}
+
+// tarChunks turns a tar stream into chunks, with every path placed under
+// prefix. Only regular files, symlinks and hard links are kept. Hard links
+// have no contents of their own in the tar; they are appended to links,
+// which is complete once the returned channel is closed, for linkChunks to
+// fill in.
+func tarChunks(r io.Reader, prefix string, links *[]hardLink) chan Chunk {
+	out := make(chan Chunk)
+
+	go func() {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatal("Error reading tar: ", err)
+			}
+
+			c := Chunk{
+				Path:        path.Join("/", prefix, hdr.Name),
+				FileSize:    hdr.Size,
+				FileModTime: hdr.ModTime,
+				FilePerm:    hdr.FileInfo().Mode(),
+				Md5sum:      "empty",
+				Uid:         uint32(hdr.Uid),
+				Gid:         uint32(hdr.Gid),
+			}
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				readChunks(tr, c, out)
+			case tar.TypeSymlink:
+				c.FileSize = int64(len(hdr.Linkname))
+				c.LinkTarget = hdr.Linkname
+				c.data = make([]byte, c.FileSize)
+				out <- c
+				progress_chan <- Progress{"scanned", (uint64)(c.FileSize)}
+			case tar.TypeLink:
+				*links = append(*links, hardLink{c.Path, path.Join("/", prefix, hdr.Linkname)})
+			case tar.TypeDir:
+			default:
+				log.Println("Skipping ", hdr.Name, ": unsupported tar entry type ", string(hdr.Typeflag))
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// ImportTar backs up the contents of a tar file ("-" for stdin) as a new
+// snapshot of host, with every path placed under prefix.
+func ImportTar(bucket string, host string, tarfile string, prefix string) {
+	var r io.Reader = os.Stdin
+	if tarfile != "-" {
+		f, err := os.Open(tarfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	progress_chan = StartProgressBar()
+	var links []hardLink
+	writeManifest(bucket, host, linkChunks(storeChunks(bucket, tarChunks(r, prefix, &links)), &links))
+	close(progress_chan)
+}
+
+// linkChunks passes stored chunks through, then gives each hard link a copy
+// of its target's chunks, already in the bucket, under its own path. A link
+// to something that isn't in the archive fails the import.
+func linkChunks(stored chan Chunk, links *[]hardLink) chan Chunk {
+	out := make(chan Chunk)
+	go func() {
+		// Only the records are kept, not the data.
+		files := make(map[string][]Chunk)
+		for c := range stored {
+			r := c
+			r.data = nil
+			files[c.Path] = append(files[c.Path], r)
+			out <- c
+		}
+		for _, l := range *links {
+			chunks, ok := files[l.target]
+			if !ok {
+				log.Fatal("Hard link ", l.path, " to ", l.target, ", which isn't in the archive")
+			}
+			for _, c := range chunks {
+				c.Path = l.path
+				files[l.path] = append(files[l.path], c)
+				out <- c
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// BackupStream backs up stdin, or the output of command if there is one, as
+// a single file at vpath in a new snapshot of host. The size and mtime of a
+// stream aren't known until it ends, so the manifest is only written then,
+// and not at all if the command fails.
+func BackupStream(bucket string, host string, vpath string, command string) {
+	var r io.Reader = os.Stdin
+	var cmd *exec.Cmd
+	if command != "" {
+		cmd = exec.Command("/bin/sh", "-c", command)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = cmd.Start()
+		if err != nil {
+			log.Fatal("Can't run ", command, ": ", err)
+		}
+		r = stdout
+	}
+
+	progress_chan = StartProgressBar()
+	var size int64
+	var mtime time.Time
+	src := make(chan Chunk)
+	go func() {
+		c := Chunk{
+			Path:     path.Join("/", vpath),
+			FilePerm: 0644,
+			Md5sum:   "empty",
+			Uid:      uint32(os.Getuid()),
+			Gid:      uint32(os.Getgid()),
+		}
+		size = readChunks(r, c, src)
+		if cmd != nil {
+			err := cmd.Wait()
+			if err != nil {
+				log.Fatal(command, " failed, not recording a backup: ", err)
+			}
+		}
+		mtime = time.Now()
+		close(src)
+	}()
+
+	stored := storeChunks(bucket, src)
+
+	// Hold on to the chunk records (but not their data) until the stream
+	// is done, then fill in what we've learned.
+	done := make(chan Chunk)
+	go func() {
+		var chunks []Chunk
+		for c := range stored {
+			c.data = nil
+			chunks = append(chunks, c)
+		}
+		for _, c := range chunks {
+			c.FileSize = size
+			c.FileModTime = mtime
+			done <- c
+		}
+		close(done)
+	}()
+	writeManifest(bucket, host, done)
+	close(progress_chan)
+}
@@ -9,6 +9,7 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 	"sync"
+	"time"
 )
 
 var (
@@ -72,23 +73,45 @@ func GetWriter(bucket string, path string, content_type string) *storage.Writer
 	return writer
 }
 
-func readObject(bucket string, path string) []byte {
-	objHandle := client.Bucket(bucket).Object(path)
-	r, err := objHandle.NewReader(ctx)
-	if err != nil {
-		log.Fatal(err)
+// GetNewWriter is GetWriter for an object that mustn't exist yet. If one
+// is created meanwhile, the write fails at Close instead of replacing it.
+func GetNewWriter(bucket string, path string, content_type string) *storage.Writer {
+	objHandle := client.Bucket(bucket).Object(path).If(storage.Conditions{DoesNotExist: true})
+	writer := objHandle.NewWriter(ctx)
+	writer.ContentType = content_type
+	return writer
+}
+
+func ObjectExists(bucket string, path string) bool {
+	_, err := StatObject(bucket, path)
+	if err == storage.ErrObjectNotExist {
+		return false
 	}
-	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Error checking ", path, ": ", err)
 	}
-	err = r.Close()
+	return true
+}
+
+func readObject(bucket string, path string) []byte {
+	data, err := tryReadObject(bucket, path)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return data
 }
 
+// tryReadObject is readObject for callers that want to retry.
+func tryReadObject(bucket string, path string) ([]byte, error) {
+	objHandle := client.Bucket(bucket).Object(path)
+	r, err := objHandle.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 func GetReader(bucket string, path string) *storage.Reader {
 	objHandle := client.Bucket(bucket).Object(path)
 	r, err := objHandle.NewReader(ctx)
@@ -141,6 +164,43 @@ func ListBucket(bucket string) <-chan string {
 	return out
 }
 
+// ObjectInfo is what the bucket says about an object. Generation changes
+// whenever the object is rewritten.
+type ObjectInfo struct {
+	Name       string
+	Generation int64
+	Created    time.Time
+}
+
+func StatObject(bucket string, path string) (ObjectInfo, error) {
+	attrs, err := client.Bucket(bucket).Object(path).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{attrs.Name, attrs.Generation, attrs.Created}, nil
+}
+
+// ListMetadataInfo is ListMetadata with each manifest's ObjectInfo.
+func ListMetadataInfo(bucket string) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+
+	go func() {
+		q := new(storage.Query)
+		q.Prefix = "/metadata"
+
+		objects := client.Bucket(bucket).Objects(ctx, q)
+		for {
+			attr, err := objects.Next()
+			if err != nil {
+				break
+			}
+			out <- ObjectInfo{attr.Name, attr.Generation, attr.Created}
+		}
+		close(out)
+	}()
+	return out
+}
+
 func ListMetadata(bucket string) <-chan string {
 	out := make(chan string)
 
@@ -0,0 +1,72 @@
+package dumpy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// FileVersion is one version of a file: its contents over a run of
+// consecutive snapshots that have the same contents.
+type FileVersion struct {
+	ContentId  string
+	Size       int64
+	ModTime    time.Time
+	LinkTarget string
+	Snapshots  []string // host/date, oldest first
+}
+
+// Newest gives the latest snapshot with this version.
+func (v FileVersion) Newest() string {
+	return v.Snapshots[len(v.Snapshots)-1]
+}
+
+// FileVersions finds p in every snapshot of host, oldest first, and starts a
+// new version each time its contents change, so going back to an earlier
+// version counts as another one. It works from the local index (see
+// LoadIndex), so only snapshots that haven't been indexed yet are
+// downloaded.
+func FileVersions(bucket string, host string, p string) []FileVersion {
+	versions := []FileVersion{}
+	snapshots := matchingSnapshots(bucket, SnapshotFilter{Host: host})
+	indexes := loadIndexes(bucket, snapshots)
+	for _, s := range snapshots {
+		entries := indexes[s.Name]
+		j := sort.Search(len(entries), func(j int) bool { return entries[j].Path >= p })
+		if j == len(entries) || entries[j].Path != p {
+			continue
+		}
+		e := entries[j]
+		if len(versions) == 0 || versions[len(versions)-1].ContentId != e.ContentId {
+			versions = append(versions, FileVersion{
+				ContentId:  e.ContentId,
+				Size:       e.Size,
+				ModTime:    e.ModTime,
+				LinkTarget: e.LinkTarget,
+			})
+		}
+		v := &versions[len(versions)-1]
+		v.Snapshots = append(v.Snapshots, s.Name)
+	}
+	return versions
+}
+
+// PrintVersions numbers the versions from 1, oldest first, with the range
+// of snapshots each one was in.
+func PrintVersions(w io.Writer, versions []FileVersion) {
+	for i, v := range versions {
+		what := humanize.Bytes(uint64(v.Size))
+		if v.LinkTarget != "" {
+			what = "-> " + v.LinkTarget
+		}
+		fmt.Fprintf(w, "%3d  %10s  %s  %.12s  ", i+1, what, v.ModTime.Format("2006-01-02 15:04"), v.ContentId)
+		if len(v.Snapshots) == 1 {
+			fmt.Fprintf(w, "%s\n", v.Snapshots[0])
+		} else {
+			fmt.Fprintf(w, "%s .. %s (%d snapshots)\n", v.Snapshots[0], v.Newest(), len(v.Snapshots))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package dumpy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// davFS adapts a SnapshotFS to webdav.FileSystem. Everything that would
+// change the tree fails with a permission error.
+type davFS struct {
+	fsys *SnapshotFS
+}
+
+// davName turns a WebDAV path ("/host/date/...") into an io/fs one.
+func davName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.fsys.Stat(davName(name))
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info}, nil
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	f, err := d.fsys.Open(davName(name))
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{f}, nil
+}
+
+// davInfo supplies content types from the file name, so that listing a
+// directory doesn't download the start of every file to sniff them.
+type davInfo struct {
+	os.FileInfo
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	if t := mime.TypeByExtension(path.Ext(i.Name())); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// davFile wraps a file, symlink or directory from SnapshotFS.
+type davFile struct {
+	fs.File
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info}, nil
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, nil // directories
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+	entries, err := d.ReadDir(count)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, ierr := e.Info()
+		if ierr != nil {
+			return infos, ierr
+		}
+		infos = append(infos, davInfo{info})
+	}
+	return infos, err
+}
+
+// ServeWebDAV shares every snapshot in the bucket read-only over WebDAV at
+// addr, laid out as /host/date/... like the interactive shell. File
+// managers can mount it without FUSE; reads fetch only the chunks that
+// cover the requested range.
+func ServeWebDAV(bucket string, addr string) error {
+	h := &webdav.Handler{
+		FileSystem: davFS{NewBucketFS(bucket)},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, os.ErrPermission) {
+				log.Println(r.Method, " ", r.URL.Path, ": ", err)
+			}
+		},
+	}
+	log.Printf("Serving %s over WebDAV on http://%s/\n", bucket, addr)
+	return http.ListenAndServe(addr, h)
+}